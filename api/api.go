@@ -0,0 +1,109 @@
+// Package api defines the protocol between the host and the worker.
+package api
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/automata-network/tee-compile/misc"
+)
+
+// Version is bumped on every incompatible change of a released protocol,
+// both sides refuse to talk to a different version. The paths carry it as
+// their /v<Version> prefix.
+const Version = 1
+
+const (
+	PathHandshake = "/v1/handshake"
+	PathSession   = "/v1/session"
+	PathBuild     = "/v1/build"
+	PathBuilds    = "/v1/builds"
+	PathBuildLog  = "/v1/builds/log"
+	PathTestSpace = "/v1/testspace"
+
+	PathUploads      = "/v1/uploads"
+	PathUploadChunk  = "/v1/uploads/chunk"
+	PathUploadStatus = "/v1/uploads/status"
+	PathUploadCommit = "/v1/uploads/commit"
+
+	PathSources = "/v1/sources"
+	PathBlobs   = "/v1/blobs"
+
+	// served by the host
+	PathLog = "/v1/log"
+)
+
+// HandshakeRequest tells the worker where to send the logs, LogCert is the
+// fingerprint of the certificate of the log listener.
+type HandshakeRequest struct {
+	Version  int    `json:"version"`
+	Software string `json:"software"`
+	Log      string `json:"log"`
+	LogCert  string `json:"log_cert"`
+}
+
+type HandshakeResponse struct {
+	Version  int    `json:"version"`
+	Software string `json:"software"`
+	// Session is the token required by every later request
+	Session string `json:"session"`
+}
+
+const (
+	// ChunkSize is the size of the chunks sent by the host
+	ChunkSize = 4 << 20
+	// MaxChunkSize is the largest chunk accepted by the worker
+	MaxChunkSize = 16 << 20
+
+	// HeaderChunkSha256 carries the hex sha256 of an uploaded chunk
+	HeaderChunkSha256 = "Chunk-Sha256"
+)
+
+type UploadRequest struct {
+	Size   int64  `json:"size"`
+	Sha256 string `json:"sha256"`
+}
+
+// UploadStatus is the progress of an upload. The chunks are appended in
+// order, a host resumes a dropped upload at Offset.
+type UploadStatus struct {
+	ID        string `json:"id"`
+	Size      int64  `json:"size"`
+	Sha256    string `json:"sha256"`
+	Offset    int64  `json:"offset"`
+	Committed bool   `json:"committed"`
+}
+
+// SourceManifest lists the source tree, the worker rebuilds it from the
+// blobs it has plus the ones the host uploads.
+type SourceManifest struct {
+	Entries []*misc.TreeEntry `json:"entries"`
+}
+
+// SourceStatus answers a manifest with the sha256 of the blobs the worker
+// lacks, the source can be built once Missing is empty.
+type SourceStatus struct {
+	ID      string   `json:"id"`
+	Missing []string `json:"missing"`
+}
+
+// SetToken authorizes req with the session token.
+func SetToken(req *http.Request, token string) {
+	req.Header.Set("Authorization", "Bearer "+token)
+}
+
+func Token(req *http.Request) string {
+	return strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+}
+
+// SessionTransport sends every request with the session token.
+type SessionTransport struct {
+	Base  http.RoundTripper
+	Token string
+}
+
+func (t *SessionTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	SetToken(req, t.Token)
+	return t.Base.RoundTrip(req)
+}
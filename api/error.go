@@ -0,0 +1,111 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/chzyer/logex"
+)
+
+type ErrorKind string
+
+var (
+	// the request can't be served as is
+	KindRequest ErrorKind = "request"
+	// the build itself failed, e.g. the build command exits with an error
+	KindBuild ErrorKind = "build"
+	// the worker failed, retrying may help
+	KindInfra ErrorKind = "infra"
+)
+
+const (
+	CodeBadRequest      = "bad_request"
+	CodeUnauthorized    = "unauthorized"
+	CodeNotFound        = "not_found"
+	CodeMethod          = "method_not_allowed"
+	CodeConflict        = "conflict"
+	CodeVersionMismatch = "version_mismatch"
+	CodeBuildFailed     = "build_failed"
+	CodeInternal        = "internal"
+)
+
+var codes = map[int]struct {
+	Code string
+	Kind ErrorKind
+}{
+	http.StatusBadRequest:          {CodeBadRequest, KindRequest},
+	http.StatusUnauthorized:        {CodeUnauthorized, KindRequest},
+	http.StatusNotFound:            {CodeNotFound, KindRequest},
+	http.StatusMethodNotAllowed:    {CodeMethod, KindRequest},
+	http.StatusConflict:            {CodeConflict, KindRequest},
+	http.StatusUpgradeRequired:     {CodeVersionMismatch, KindRequest},
+	http.StatusUnprocessableEntity: {CodeBuildFailed, KindBuild},
+}
+
+type Error struct {
+	Status  int       `json:"status"`
+	Code    string    `json:"code"`
+	Kind    ErrorKind `json:"kind"`
+	Message string    `json:"message"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%v error(%v): %v", e.Kind, e.Code, e.Message)
+}
+
+// NewError classifies err by its logex code, which is used as the http
+// status. Errors without a code are infra errors.
+func NewError(err error) *Error {
+	if e, ok := err.(*Error); ok {
+		return e
+	}
+	status := http.StatusInternalServerError
+	if coder, ok := err.(interface{ GetCode() int }); ok {
+		status = coder.GetCode()
+	}
+	ret := &Error{Status: status, Code: CodeInternal, Kind: KindInfra, Message: err.Error()}
+	if code, ok := codes[status]; ok {
+		ret.Code = code.Code
+		ret.Kind = code.Kind
+	}
+	return ret
+}
+
+// WithStatus tags err with the http status it should be reported with.
+func WithStatus(err error, status int) error {
+	if err == nil {
+		return nil
+	}
+	return logex.TraceEx(1, err).SetCode(status)
+}
+
+func WriteError(w http.ResponseWriter, err error) {
+	e := NewError(err)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(e.Status)
+	json.NewEncoder(w).Encode(e)
+}
+
+func WriteJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// CheckResponse returns the *Error carried by a failed response.
+func CheckResponse(response *http.Response) error {
+	if response.StatusCode == http.StatusOK {
+		return nil
+	}
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		return logex.Trace(err)
+	}
+	var e Error
+	if err := json.Unmarshal(body, &e); err != nil || e.Code == "" {
+		e = *NewError(WithStatus(fmt.Errorf("%s", body), response.StatusCode))
+	}
+	e.Status = response.StatusCode
+	return &e
+}
@@ -0,0 +1,88 @@
+package api
+
+import (
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+
+	"github.com/chzyer/logex"
+)
+
+// the parts of a build response
+const (
+	PartOutput     = "output"
+	PartReport     = "report"
+	PartProvenance = "provenance"
+	PartProofs     = "proofs"
+	PartTranscript = "transcript"
+)
+
+// ProofsPart names the proofs of a hash algorithm, the algorithm of the
+// attested hashes uses PartProofs.
+func ProofsPart(algorithm string, attested bool) string {
+	if attested {
+		return PartProofs
+	}
+	return PartProofs + "-" + algorithm
+}
+
+type Part struct {
+	Name        string
+	ContentType string
+	Body        io.Reader
+}
+
+// WriteParts streams the parts as a multipart/mixed response.
+func WriteParts(w http.ResponseWriter, parts []*Part) error {
+	mw := multipart.NewWriter(w)
+	w.Header().Set("Content-Type", mime.FormatMediaType("multipart/mixed", map[string]string{
+		"boundary": mw.Boundary(),
+	}))
+	w.WriteHeader(http.StatusOK)
+	for _, part := range parts {
+		header := make(textproto.MIMEHeader)
+		header.Set("Content-Disposition", mime.FormatMediaType("form-data", map[string]string{
+			"name": part.Name,
+		}))
+		header.Set("Content-Type", part.ContentType)
+		pw, err := mw.CreatePart(header)
+		if err != nil {
+			return logex.Trace(err)
+		}
+		if _, err := io.Copy(pw, part.Body); err != nil {
+			return logex.Trace(err, part.Name)
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return logex.Trace(err)
+	}
+	return nil
+}
+
+// ReadParts calls fn for every part of a multipart response in order.
+func ReadParts(response *http.Response, fn func(name string, body io.Reader) error) error {
+	mediaType, params, err := mime.ParseMediaType(response.Header.Get("Content-Type"))
+	if err != nil {
+		return logex.Trace(err)
+	}
+	if mediaType != "multipart/mixed" {
+		return logex.NewErrorf("unexpected content type: %v", mediaType)
+	}
+	mr := multipart.NewReader(response.Body, params["boundary"])
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return logex.Trace(err)
+		}
+		err = fn(part.FormName(), part)
+		part.Close()
+		if err != nil {
+			return logex.Trace(err)
+		}
+	}
+}
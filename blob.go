@@ -0,0 +1,235 @@
+package main
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/automata-network/tee-compile/api"
+	"github.com/automata-network/tee-compile/misc"
+	"github.com/chzyer/logex"
+)
+
+type blob struct {
+	size int64
+	used time.Time
+}
+
+// BlobStore is the content-addressed store of the source files. It lives
+// as long as the worker, so a warm enclave only receives the files that
+// changed since the previous build. The least recently used blobs are
+// dropped beyond Limit, except the ones referenced by a pending source.
+type BlobStore struct {
+	Dir   string
+	Limit int64
+
+	mu      sync.Mutex
+	blobs   map[string]*blob
+	size    int64
+	seq     int
+	sources map[string][]*misc.TreeEntry
+}
+
+func NewBlobStore(dir string, limit int64) (*BlobStore, error) {
+	if err := os.RemoveAll(dir); err != nil {
+		return nil, logex.Trace(err)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, logex.Trace(err)
+	}
+	return &BlobStore{
+		Dir:     dir,
+		Limit:   limit,
+		blobs:   make(map[string]*blob),
+		sources: make(map[string][]*misc.TreeEntry),
+	}, nil
+}
+
+func (s *BlobStore) path(sum string) string {
+	return filepath.Join(s.Dir, sum)
+}
+
+// missing returns the blobs the entries refer to but the store lacks.
+func (s *BlobStore) missing(entries []*misc.TreeEntry) []string {
+	now := time.Now()
+	seen := make(map[string]bool)
+	missing := []string{}
+	for _, entry := range entries {
+		if entry.Type != misc.TreeFile || seen[entry.Sha256] {
+			continue
+		}
+		seen[entry.Sha256] = true
+		if b, ok := s.blobs[entry.Sha256]; ok {
+			b.used = now
+			continue
+		}
+		missing = append(missing, entry.Sha256)
+	}
+	sort.Strings(missing)
+	return missing
+}
+
+func (s *BlobStore) AddSource(manifest *api.SourceManifest) (*api.SourceStatus, error) {
+	for _, entry := range manifest.Entries {
+		if entry.Type != misc.TreeFile {
+			continue
+		}
+		if sum, err := hex.DecodeString(entry.Sha256); err != nil || len(sum) != sha256.Size {
+			return nil, api.WithStatus(logex.NewErrorf("invalid sha256 of %v: %q", entry.Path, entry.Sha256), http.StatusBadRequest)
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.seq++
+	id := fmt.Sprint(s.seq)
+	s.sources[id] = manifest.Entries
+	return &api.SourceStatus{ID: id, Missing: s.missing(manifest.Entries)}, nil
+}
+
+func (s *BlobStore) Status(id string) (*api.SourceStatus, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entries, ok := s.sources[id]
+	if !ok {
+		return nil, api.WithStatus(logex.NewErrorf("source %q not found", id), http.StatusNotFound)
+	}
+	return &api.SourceStatus{ID: id, Missing: s.missing(entries)}, nil
+}
+
+// Ingest stores the blobs of a tarball whose entries are named by the
+// sha256 of their content.
+func (s *BlobStore) Ingest(tarFile string) (int, error) {
+	fd, err := os.Open(tarFile)
+	if err != nil {
+		return 0, logex.Trace(err)
+	}
+	defer fd.Close()
+	count := 0
+	tr := tar.NewReader(fd)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return count, api.WithStatus(err, http.StatusBadRequest)
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		if err := s.put(header.Name, tr); err != nil {
+			return count, logex.Trace(err)
+		}
+		count++
+	}
+	s.mu.Lock()
+	s.evict()
+	s.mu.Unlock()
+	return count, nil
+}
+
+func (s *BlobStore) put(sum string, r io.Reader) error {
+	tmp, err := os.CreateTemp(s.Dir, "blob-*")
+	if err != nil {
+		return logex.Trace(err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, hash), r)
+	if err != nil {
+		return logex.Trace(err)
+	}
+	if actual := hex.EncodeToString(hash.Sum(nil)); actual != sum {
+		return api.WithStatus(logex.NewErrorf("blob %q has sha256 %v", sum, actual), http.StatusBadRequest)
+	}
+	if err := tmp.Close(); err != nil {
+		return logex.Trace(err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.blobs[sum]; ok {
+		return nil
+	}
+	if err := os.Rename(tmp.Name(), s.path(sum)); err != nil {
+		return logex.Trace(err)
+	}
+	s.blobs[sum] = &blob{size: size, used: time.Now()}
+	s.size += size
+	return nil
+}
+
+func (s *BlobStore) evict() {
+	if s.Limit <= 0 || s.size <= s.Limit {
+		return
+	}
+	pinned := make(map[string]bool)
+	for _, entries := range s.sources {
+		for _, entry := range entries {
+			pinned[entry.Sha256] = true
+		}
+	}
+	sums := make([]string, 0, len(s.blobs))
+	for sum := range s.blobs {
+		if !pinned[sum] {
+			sums = append(sums, sum)
+		}
+	}
+	sort.Slice(sums, func(i, j int) bool {
+		return s.blobs[sums[i]].used.Before(s.blobs[sums[j]].used)
+	})
+	for _, sum := range sums {
+		if s.size <= s.Limit {
+			break
+		}
+		os.Remove(s.path(sum))
+		s.size -= s.blobs[sum].size
+		delete(s.blobs, sum)
+	}
+}
+
+// Materialize writes the source tree to dst, all its blobs must be in the
+// store. The source is consumed.
+func (s *BlobStore) Materialize(id string, dst string) error {
+	s.mu.Lock()
+	entries, ok := s.sources[id]
+	if !ok {
+		s.mu.Unlock()
+		return api.WithStatus(logex.NewErrorf("source %q not found", id), http.StatusNotFound)
+	}
+	if missing := s.missing(entries); len(missing) > 0 {
+		s.mu.Unlock()
+		return api.WithStatus(logex.NewErrorf("source %v lacks %v blobs", id, len(missing)), http.StatusConflict)
+	}
+	s.mu.Unlock()
+
+	// the blobs are pinned by the source until it's consumed
+	defer func() {
+		s.mu.Lock()
+		delete(s.sources, id)
+		s.mu.Unlock()
+	}()
+	if err := misc.MaterializeTree(entries, s.path, dst); err != nil {
+		return api.WithStatus(err, http.StatusBadRequest)
+	}
+	return nil
+}
+
+// RemoveSources drops the pending sources of a closed session, the blobs
+// are kept for the next sessions.
+func (s *BlobStore) RemoveSources(ids []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, id := range ids {
+		delete(s.sources, id)
+	}
+}
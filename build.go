@@ -2,8 +2,9 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/rand"
-	"encoding/base64"
+	"crypto/tls"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
@@ -14,28 +15,68 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"sort"
+	"strings"
 	"time"
 
+	"github.com/automata-network/tee-compile/api"
+	"github.com/automata-network/tee-compile/build"
 	"github.com/automata-network/tee-compile/misc"
 	"github.com/chzyer/logex"
 	"github.com/hf/nitrite"
-	"github.com/mdlayher/vsock"
 )
 
 type BuildToolBuild struct {
-	Dir    string `default:"."`
-	Listen string `default:"vsock://:12346"`
-	Vendor string
-	Nitro  string
-	Mem    string `default:"12288"`
-	Output string
-	Nonce  string
-	Debug  bool
-
-	Server *http.Server `flagly:"-"`
+	Dir         string `default:"."`
+	Manifest    string `default:"build.json" desc:"path of the manifest in -dir"`
+	Listen      string `desc:"log listener, vsock://:0 in nitro mode, tcp://127.0.0.1:0 otherwise"`
+	Vendor      string
+	Nitro       string
+	Docker      string `desc:"run the worker in a docker container of the image"`
+	Cpus        int    `default:"0" desc:"override resources.cpus of the manifest"`
+	Mem         int    `default:"0" desc:"override resources.memory(MiB) of the manifest"`
+	Workspace   int    `default:"0" desc:"override resources.workspace(MiB) of the manifest"`
+	Allocator   string `desc:"config of the nitro enclaves allocator, default to /etc/nitro_enclaves/allocator.yaml"`
+	Output      string `desc:"prefix of the saved files, <output>.tar, <output>.log..."`
+	Nonce       string
+	Debug       bool
+	Pool        string        `desc:"state file of the enclave pool"`
+	PoolSize    int           `default:"1" desc:"max number of enclaves in the pool"`
+	PoolTimeout time.Duration `default:"30m" desc:"time to wait for a free enclave"`
+	Cid         int           `default:"16" desc:"first cid allocated to the enclaves"`
+	Keep        bool          `desc:"keep the enclave warm for the next build"`
+	Pcr0        string        `desc:"expected PCR0 of the enclave, defaults to the measurement of the -nitro image"`
+	Pcr1        string        `desc:"expected PCR1 of the enclave"`
+	Pcr2        string        `desc:"expected PCR2 of the enclave"`
+
+	StartupTimeout time.Duration `default:"5m" desc:"time to wait for the worker to boot"`
+	UploadRetries  int           `default:"5" desc:"times to resume a failed upload"`
+	Hash           string        `desc:"hash algorithms of the merkle roots, comma separated, overrides the manifest"`
+	NoDelta        bool          `desc:"upload the whole source tarball instead of the missing files"`
+	HashCache      bool          `desc:"cache the hashes of the source files on the host, see tee-compile cache"`
+	HashCacheFile  string        `desc:"file of the hash cache, default to ~/.tee-compile/hashcache.json"`
+
+	Server  *http.Server      `flagly:"-"`
+	logURI  *url.URL          `flagly:"-"`
+	logs    *misc.LogReceiver `flagly:"-"`
+	logCert string            `flagly:"-"`
+	token   string            `flagly:"-"`
+}
+
+func (b *BuildToolBuild) Mode() BuildMode {
+	if b.Nitro != "" {
+		return NitroBuildMode
+	}
+	if b.Docker != "" {
+		return DockerBuildMode
+	}
+	return LocalBuildMode
 }
 
 func (b *BuildToolBuild) FlaglyHandle() error {
+	if b.Output == "" {
+		return logex.NewErrorf("missing -output")
+	}
 	if b.Nonce == "" {
 		var nonce [16]byte
 		rand.Read(nonce[:])
@@ -50,7 +91,44 @@ func (b *BuildToolBuild) FlaglyHandle() error {
 		return logex.Trace(err)
 	}
 
-	var vendorTars [][2]string
+	manifest, err := build.LoadManifest(".", b.Manifest)
+	if err != nil {
+		return logex.Trace(err)
+	}
+	hashAlgorithms := manifest.HashAlgorithms
+	if b.Hash != "" {
+		hashAlgorithms = strings.Split(b.Hash, ",")
+	}
+	algorithms, err := misc.ParseHashAlgorithms(hashAlgorithms)
+	if err != nil {
+		return logex.Trace(err)
+	}
+
+	var cache *misc.HashCache
+	if b.HashCache {
+		cache, err = misc.OpenHashCache(b.HashCacheFile)
+		if err != nil {
+			return logex.Trace(err)
+		}
+		defer func() {
+			if err := cache.Save(); err != nil {
+				logex.Error(err)
+			}
+		}()
+	}
+	resources := manifest.Resources.
+		Override(&build.Resources{Cpus: b.Cpus, Memory: b.Mem, Workspace: b.Workspace})
+	if b.Mode() == NitroBuildMode {
+		// the enclave is sized for the build, outside it the worker
+		// falls back to its own defaults
+		resources = (&build.Resources{Cpus: misc.NitroDefaultCpus, Memory: misc.NitroDefaultMemory}).Override(resources)
+		if err := b.checkResources(resources); err != nil {
+			return logex.Trace(err)
+		}
+	}
+	logex.Infof("resources: cpus=%v, memory=%vMiB, workspace=%vMiB", resources.Cpus, resources.Memory, resources.Workspace)
+
+	var vendorTars []string
 
 	if b.Vendor != "" {
 		vendorDir, err := os.MkdirTemp("", "vendor*")
@@ -62,7 +140,7 @@ func (b *BuildToolBuild) FlaglyHandle() error {
 		if err := misc.Exec(nil, "docker", "run", "--rm",
 			"-v", fmt.Sprintf("%v:/tmp/vendor", vendorDir),
 			"-v", fmt.Sprintf("%v:/workspace/code", cwd),
-			b.Vendor, "/workspace/tee-compile", "vendor", "-dir", "/workspace/code",
+			b.Vendor, "/workspace/tee-compile", "vendor", "-dir", "/workspace/code", "-manifest", manifest.Path,
 		); err != nil {
 			return logex.Trace(err)
 		}
@@ -71,10 +149,7 @@ func (b *BuildToolBuild) FlaglyHandle() error {
 			return logex.Trace(err)
 		}
 		for _, vendor := range dir {
-			vendorTars = append(vendorTars, [2]string{
-				filepath.Join(vendorDir, vendor.Name()),
-				"/root",
-			})
+			vendorTars = append(vendorTars, filepath.Join(vendorDir, vendor.Name()))
 		}
 	}
 
@@ -82,20 +157,64 @@ func (b *BuildToolBuild) FlaglyHandle() error {
 	if err := os.Chdir(b.Dir); err != nil {
 		return logex.Trace(err)
 	}
-	tarFile, err := misc.Tar(nil, "sourcecode", []string{"."})
+
+	// -output may point into the tree, the files the host writes are never
+	// part of the source and the source is taken before they are created
+	outputFiles, err := b.outputFiles(manifest, algorithms)
 	if err != nil {
 		return logex.Trace(err)
 	}
-	defer func() {
-		os.Remove(tarFile)
-	}()
-
-	tarFd, err := os.Open(tarFile)
+	excluded, err := treeFiles(cwd, outputFiles)
 	if err != nil {
 		return logex.Trace(err)
 	}
-	logex.Info("package tar file to:", tarFd.Name())
-	defer tarFd.Close()
+	var sourceFiles []string
+	for _, fp := range excluded {
+		sourceFiles = append(sourceFiles, "--exclude=./"+patternEscape(fp))
+	}
+	sourceFiles = append(sourceFiles, ".")
+	var sourceTar string
+	var sourceEntries []*misc.TreeEntry
+	if b.NoDelta {
+		sourceTar, err = misc.Tar(nil, ".", "sourcecode", sourceFiles)
+		if err != nil {
+			return logex.Trace(err)
+		}
+		defer os.Remove(sourceTar)
+		logex.Info("package tar file to:", sourceTar)
+	} else {
+		sourceEntries, err = misc.ScanTree(".", cache, func(path string) bool {
+			for _, fp := range excluded {
+				if path == fp {
+					return true
+				}
+			}
+			return false
+		})
+		if err != nil {
+			return logex.Trace(err)
+		}
+	}
+
+	// the enclave hashes the source again, comparing the roots makes sure
+	// it built the tree taken above. It reads every file, so only with the
+	// hash cache.
+	var inputHashes map[misc.HashAlgorithm]string
+	if cache != nil {
+		hashPaths := manifest.Input.HashPaths()
+		for _, fp := range excluded {
+			hashPaths = append(hashPaths, "!"+patternEscape(fp))
+		}
+		inputResults, err := misc.FilesMerkleTrees(context.Background(), ".", hashPaths, algorithms, 0, cache, nil)
+		if err != nil {
+			return logex.Trace(err)
+		}
+		inputRoots := make([][]byte, len(inputResults))
+		for idx, result := range inputResults {
+			inputRoots[idx] = result.Root
+		}
+		inputHashes = misc.RootHashes(algorithms, inputRoots)
+	}
 
 	targetFile, err := os.OpenFile(b.Output+".tar", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0755)
 	if err != nil {
@@ -103,145 +222,437 @@ func (b *BuildToolBuild) FlaglyHandle() error {
 	}
 	defer targetFile.Close()
 
-	var cmd *exec.Cmd
-	var client *http.Client
-	var endpoint string
-	if b.Nitro != "" {
-		misc.Exec(nil, "nitro-cli", "terminate-enclave", "--all")
-		cmd = misc.RunNitroEnclave(b.Nitro, b.Mem, b.Debug)
-		if err := cmd.Start(); err != nil {
+	logFile, err := os.OpenFile(b.Output+".log", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return logex.Trace(err)
+	}
+	defer logFile.Close()
+	b.logs = misc.NewLogReceiver((&misc.LogOutput{}).WithPrefix("enclave: "), logFile)
+	b.logs.Debug = b.Debug
+
+	var workerURI *url.URL
+	verifier := &misc.RATLSVerifier{}
+	startup := &Startup{
+		Timeout:    b.StartupTimeout,
+		MinBackoff: 500 * time.Millisecond,
+		MaxBackoff: 10 * time.Second,
+	}
+	switch b.Mode() {
+	case NitroBuildMode:
+		if err := b.initVerifier(verifier); err != nil {
 			return logex.Trace(err)
 		}
-		client = misc.NewVsockClient(nil)
-		endpoint = "http://11:12345"
-	} else {
+		spec, err := NewEnclaveSpec(b.Nitro, resources.Cpus, resources.Memory, b.Debug)
+		if err != nil {
+			return logex.Trace(err)
+		}
+		pool := NewEnclavePool(b.Pool, b.PoolSize, uint32(b.Cid))
+		enclave, err := pool.Acquire(spec, b.PoolTimeout)
+		if err != nil {
+			return logex.Trace(err)
+		}
+		defer func() {
+			// a worker failed to start is never reused
+			keep := b.Keep && startup.State == StartupReady
+			if err := pool.Release(enclave, keep); err != nil {
+				logex.Error(err)
+			}
+		}()
+		if b.Debug {
+			startup.Console = misc.NewTailBuffer(64 << 10)
+			console := misc.NitroEnclaveConsole(enclave.ID)
+			console.Stdout = io.MultiWriter(os.Stdout, startup.Console)
+			console.Stderr = io.MultiWriter(os.Stderr, startup.Console)
+			if err := console.Start(); err != nil {
+				return logex.Trace(err)
+			}
+			defer func() {
+				console.Process.Kill()
+				console.Wait()
+			}()
+		}
+		startup.Exited = nitroEnclaveExited(enclave.ID)
+		workerURI = &url.URL{Scheme: "vsock", Host: fmt.Sprintf("%v:12345", enclave.CID)}
+	case DockerBuildMode:
+		port, err := misc.FreePort()
+		if err != nil {
+			return logex.Trace(err)
+		}
+		workerURI = &url.URL{Scheme: "tcp", Host: fmt.Sprintf("127.0.0.1:%v", port)}
+		var name [8]byte
+		rand.Read(name[:])
+		container := fmt.Sprintf("tee-compile-%x", name)
+		cmd := exec.Command("docker", "run", "--rm", "--network", "host", "--name", container,
+			b.Docker, "tee-compile", "worker", "-insecure", "-listen", workerURI.String(), "-dir", "/workspace/builds")
+		stop, err := b.startWorkerProcess(cmd, startup)
+		if err != nil {
+			return logex.Trace(err)
+		}
+		defer stop(func() {
+			misc.Exec(nil, "docker", "rm", "-f", container)
+		})
+	default:
 		// local mode
-		cmd = exec.Command(os.Args[0], "worker", "-listen", "tcp://localhost:12345")
-		cmd.Stderr = os.Stderr
-		cmd.Stdin = os.Stdin
-		cmd.Stdout = os.Stdout
-		if err := cmd.Start(); err != nil {
+		tmpDir, err := os.MkdirTemp("", "tee-compile-*")
+		if err != nil {
 			return logex.Trace(err)
 		}
-		client = http.DefaultClient
-		endpoint = "http://localhost:12345"
+		defer os.RemoveAll(tmpDir)
+		workerURI = &url.URL{Scheme: "unix", Path: filepath.Join(tmpDir, "worker.sock")}
+		cmd := exec.Command(os.Args[0], "worker", "-insecure",
+			"-listen", workerURI.String(), "-dir", filepath.Join(tmpDir, "builds"))
+		stop, err := b.startWorkerProcess(cmd, startup)
+		if err != nil {
+			return logex.Trace(err)
+		}
+		defer stop(nil)
 	}
+	client := misc.NewTLSClient(workerURI, verifier.TLSConfig())
+	endpoint := misc.TLSURLBase(workerURI)
 
+	wait, err := b.RunServer()
+	if err != nil {
+		return logex.Trace(err)
+	}
 	go func() {
-		wait, err := b.RunServer()
-		if err != nil {
-			logex.Fatal(err)
-		}
 		if err := wait(); err != nil {
 			logex.Fatal(err)
 		}
 	}()
 
-	uri, err := url.Parse(b.Listen)
-	if err != nil {
-		return logex.Trace(err)
+	startup.Ping = func() error {
+		return b.handshake(client, endpoint)
 	}
-	vsockId, err := vsock.ContextID()
-	if err != nil {
+	if err := startup.Wait(); err != nil {
 		return logex.Trace(err)
 	}
+	if doc := verifier.Document(); doc != nil {
+		logex.Infof("worker attested: PCR0=%x", doc.PCRs[0])
+	}
+	client.Transport = &api.SessionTransport{Base: client.Transport, Token: b.token}
+	defer b.closeSession(client, endpoint)
 
-	for {
-		_, err := client.Get(endpoint + "/ping?" + url.Values{
-			"host": {fmt.Sprintf("%v:%v", vsockId, uri.Port())},
-		}.Encode())
+	uploader := &Uploader{Client: client, Endpoint: endpoint, Retries: b.UploadRetries}
+	query := url.Values{"nonce": {b.Nonce}, "manifest": {manifest.Path}}
+	for _, tarFile := range vendorTars {
+		id, err := uploader.Upload(tarFile)
 		if err != nil {
-			logex.Errorf("connecting to the enclave... retry in 5secs")
-			time.Sleep(5 * time.Second)
-			continue
+			return logex.Trace(err)
 		}
-		break
+		query.Add("vendor", id)
 	}
-
-	for _, tf := range vendorTars {
-		fd, err := os.Open(tf[0])
+	if b.Hash != "" {
+		query.Set("hash", b.Hash)
+	}
+	if b.NoDelta {
+		upload, err := uploader.Upload(sourceTar)
 		if err != nil {
 			return logex.Trace(err)
 		}
-		query := url.Values{"target": {tf[1]}}
-		response, err := client.Post(endpoint+"/vendor?"+query.Encode(), "application/octet-stream", fd)
-		fd.Close()
+		query.Set("upload", upload)
+	} else {
+		source, err := uploader.UploadSource(".", sourceEntries)
 		if err != nil {
 			return logex.Trace(err)
 		}
-		if err := checkResponseError(response); err != nil {
+		query.Set("source", source)
+	}
+	// in nitro mode the cpus and the memory size the enclave, the worker
+	// reserves its own defaults out of what the enclave has
+	reserve := map[string]int{"workspace": resources.Workspace}
+	if b.Mode() != NitroBuildMode {
+		reserve["cpus"] = resources.Cpus
+		reserve["mem"] = resources.Memory
+	}
+	for key, value := range reserve {
+		if value != 0 {
+			query.Set(key, fmt.Sprint(value))
+		}
+	}
+	response, err := client.Post(endpoint+api.PathBuild+"?"+query.Encode(), "", nil)
+	if err != nil {
+		return logex.Trace(err)
+	}
+
+	defer response.Body.Close()
+	if err := api.CheckResponse(response); err != nil {
+		return logex.Trace(err)
+	}
+
+	parts := make(map[string]string)
+	if err := api.ReadParts(response, func(name string, body io.Reader) error {
+		if name == api.PartOutput {
+			_, err := io.Copy(targetFile, body)
+			parts[name] = targetFile.Name()
 			return logex.Trace(err)
 		}
+		fp, err := buildPartFile(b.Output, name)
+		if err != nil {
+			return logex.Trace(err)
+		}
+		if !outputFiles[fp] {
+			// only the files left out of the source are written
+			return logex.NewErrorf("unexpected part %q in the build response", name)
+		}
+		fd, err := os.OpenFile(fp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+		if err != nil {
+			return logex.Trace(err)
+		}
+		defer fd.Close()
+		if _, err := io.Copy(fd, body); err != nil {
+			return logex.Trace(err, name)
+		}
+		parts[name] = fp
+		return nil
+	}); err != nil {
+		return logex.Trace(err)
 	}
 
-	query := url.Values{"nonce": {b.Nonce}}
-	response, err := client.Post(endpoint+"/build?"+query.Encode(), "application/octet-stream", tarFd)
-	tarFd.Close()
+	// the outputs are only trusted through the attestation
+	if parts[api.PartReport] == "" {
+		return logex.NewErrorf("missing %v in the build response", api.PartReport)
+	}
+	reportBytes, err := os.ReadFile(parts[api.PartReport])
 	if err != nil {
 		return logex.Trace(err)
 	}
 
-	defer cmd.Wait()
-	defer response.Body.Close()
-	if err := checkResponseError(response); err != nil {
+	report, err := nitrite.Verify(reportBytes, nitrite.VerifyOptions{
+		CurrentTime: time.Now(),
+	})
+	if err != nil {
 		return logex.Trace(err)
 	}
 
-	if _, err := io.Copy(targetFile, response.Body); err != nil {
+	var userData misc.AttestationReport
+	if err := json.Unmarshal(report.Document.UserData, &userData); err != nil {
+		return logex.Trace(err)
+	}
+	if userData.Nonce != b.Nonce || string(report.Document.Nonce) != b.Nonce {
+		return logex.NewErrorf("nonce mismatch: attested %q, expect %q", userData.Nonce, b.Nonce)
+	}
+	if userData.Manifest != manifest.Path || userData.ManifestHash != manifest.Hash {
+		return logex.NewErrorf("manifest mismatch: attested %v(%v), expect %v(%v)",
+			userData.Manifest, userData.ManifestHash, manifest.Path, manifest.Hash)
+	}
+	if err := verifyInputHashes(inputHashes, userData.InputHashes); err != nil {
 		return logex.Trace(err)
 	}
+	if err := verifyBuildParts(parts, &userData); err != nil {
+		return logex.Trace(err)
+	}
+	dst := bytes.NewBuffer(nil)
+	dst.WriteString("## Attestation Report\n")
+	dst.WriteString("**PCR0**: \n `0x" + hex.EncodeToString(report.Document.PCRs[0]) + "`\n")
+	dst.WriteString("\n**Report User Data**:\n")
+	dst.WriteString("```\n")
+	if err := json.Indent(dst, report.Document.UserData, "", "\t"); err != nil {
+		logex.Error(err)
+	}
+	dst.WriteString("\n```\n")
+	if err := os.WriteFile(b.Output+".txt", dst.Bytes(), 0666); err != nil {
+		logex.Error(err)
+	}
+	if parts[api.PartOutput] == "" {
+		// a matrix build saves an output per variant instead
+		targetFile.Close()
+		os.Remove(targetFile.Name())
+	}
+	for _, fp := range parts {
+		logex.Info("save file to:", fp)
+	}
+
+	return nil
+}
 
-	report := response.Header.Get("Report")
-	if report != "" {
-		reportBytes, err := base64.URLEncoding.DecodeString(report)
+// outputFiles returns every file the host may write for the build, the
+// parts of the response of each matrix variant along with <output>.log and
+// <output>.txt.
+func (b *BuildToolBuild) outputFiles(manifest *build.Manifest, algorithms []misc.HashAlgorithm) (map[string]bool, error) {
+	files := map[string]bool{
+		b.Output + ".log": true,
+		b.Output + ".txt": true,
+	}
+	names := []string{api.PartReport, api.PartProvenance, api.PartTranscript}
+	variants := []string{""}
+	for _, variant := range manifest.Matrix {
+		variants = append(variants, "."+variant.Name)
+	}
+	for _, variant := range variants {
+		names = append(names, api.PartOutput+variant)
+		for idx, algorithm := range algorithms {
+			names = append(names, api.ProofsPart(string(algorithm), idx == 0)+variant)
+		}
+	}
+	for _, name := range names {
+		fp, err := buildPartFile(b.Output, name)
 		if err != nil {
-			logex.Error("decode report fail:", err)
+			return nil, logex.Trace(err)
 		}
+		files[fp] = true
+	}
+	return files, nil
+}
 
-		report, err := nitrite.Verify(reportBytes, nitrite.VerifyOptions{
-			CurrentTime: time.Now(),
-		})
+// treeFiles returns the slash paths relative to the tree in cwd of the
+// files inside it.
+func treeFiles(cwd string, files map[string]bool) ([]string, error) {
+	var ret []string
+	for fp := range files {
+		abs, err := filepath.Abs(fp)
 		if err != nil {
-			return logex.Trace(err)
+			return nil, logex.Trace(err)
 		}
-
-		if err := os.WriteFile(b.Output+".report", reportBytes, 0666); err != nil {
-			logex.Error(err)
+		if !misc.IsSubPath(cwd, abs) {
+			continue
 		}
-		dst := bytes.NewBuffer(nil)
-		dst.WriteString("## Attestation Report\n")
-		dst.WriteString("**PCR0**: \n `0x" + hex.EncodeToString(report.Document.PCRs[0]) + "`\n")
-		dst.WriteString("\n**Report User Data**:\n")
-		dst.WriteString("```\n")
-		if err := json.Indent(dst, report.Document.UserData, "", "\t"); err != nil {
-			logex.Error(err)
+		rel, err := filepath.Rel(cwd, abs)
+		if err != nil {
+			return nil, logex.Trace(err)
 		}
-		dst.WriteString("\n```\n")
-		if err := os.WriteFile(b.Output+".txt", dst.Bytes(), 0666); err != nil {
-			logex.Error(err)
+		ret = append(ret, filepath.ToSlash(rel))
+	}
+	sort.Strings(ret)
+	return ret, nil
+}
+
+// patternEscape quotes the wildcards of a tar or a glob pattern, both
+// take the same escapes.
+func patternEscape(s string) string {
+	var buf strings.Builder
+	for _, c := range s {
+		if strings.ContainsRune(`*?[\`, c) {
+			buf.WriteByte('\\')
 		}
+		buf.WriteRune(c)
 	}
-	logex.Info("save file to:", targetFile.Name())
+	return buf.String()
+}
 
+// handshake exchanges the protocol versions with the worker and tells it
+// where to send the logs. A worker which answers with a different version
+// is reported as an *api.Error, retrying won't help.
+func (b *BuildToolBuild) handshake(client *http.Client, endpoint string) error {
+	body, err := json.Marshal(&api.HandshakeRequest{
+		Version:  api.Version,
+		Software: Version,
+		Log:      b.logURI.String(),
+		LogCert:  b.logCert,
+	})
+	if err != nil {
+		return logex.Trace(err)
+	}
+	response, err := client.Post(endpoint+api.PathHandshake, "application/json", bytes.NewReader(body))
+	if err != nil {
+		var certErr *misc.RATLSError
+		if errors.As(err, &certErr) {
+			return certErr
+		}
+		return logex.Trace(err)
+	}
+	defer response.Body.Close()
+	if err := api.CheckResponse(response); err != nil {
+		return err
+	}
+	var ret api.HandshakeResponse
+	if err := json.NewDecoder(response.Body).Decode(&ret); err != nil || ret.Version == 0 {
+		// workers before the versioned protocol answer any path with an empty 200
+		return api.NewError(api.WithStatus(logex.NewErrorf(
+			"the worker doesn't speak protocol v%v, the enclave image is older than this host(%v)",
+			api.Version, Version,
+		), http.StatusUpgradeRequired))
+	}
+	if ret.Version != api.Version {
+		return api.NewError(api.WithStatus(logex.NewErrorf(
+			"worker(%v) speaks protocol v%v, host(%v) speaks v%v",
+			ret.Software, ret.Version, Version, api.Version,
+		), http.StatusUpgradeRequired))
+	}
+	if ret.Software != Version {
+		logex.Warn(fmt.Sprintf("worker version %v differs from host version %v", ret.Software, Version))
+	}
+	b.token = ret.Session
 	return nil
 }
 
+// closeSession frees the worker for the next host, a warm enclave would
+// refuse it until the session times out otherwise.
+func (b *BuildToolBuild) closeSession(client *http.Client, endpoint string) {
+	req, err := http.NewRequest(http.MethodDelete, endpoint+api.PathSession, nil)
+	if err != nil {
+		logex.Error(err)
+		return
+	}
+	response, err := client.Do(req)
+	if err != nil {
+		logex.Error("close session:", err)
+		return
+	}
+	defer response.Body.Close()
+	if err := api.CheckResponse(response); err != nil {
+		logex.Error("close session:", err)
+	}
+}
+
 func (b *BuildToolBuild) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	defer req.Body.Close()
 	switch req.URL.Path {
-	case "/log":
-		data, err := io.ReadAll(req.Body)
-		if err != nil {
-			w.WriteHeader(400)
-			fmt.Fprint(w, err.Error())
+	case api.PathLog:
+		if req.Method != http.MethodPost {
+			api.WriteError(w, api.WithStatus(logex.NewErrorf("%v requires POST", req.URL.Path), http.StatusMethodNotAllowed))
+			return
+		}
+		if err := b.logs.Receive(req.Body); err != nil {
+			api.WriteError(w, api.WithStatus(err, http.StatusBadRequest))
 			return
 		}
-		fmt.Printf("enclave: %s", data)
+	default:
+		api.WriteError(w, api.WithStatus(logex.NewErrorf("unknown path: %v", req.URL.Path), http.StatusNotFound))
+	}
+}
+
+// startWorkerProcess runs the worker as a child process, the returned func
+// stops it.
+func (b *BuildToolBuild) startWorkerProcess(cmd *exec.Cmd, startup *Startup) (func(kill func()), error) {
+	startup.Console = misc.NewTailBuffer(64 << 10)
+	cmd.Stderr = io.MultiWriter(os.Stderr, startup.Console)
+	cmd.Stdout = io.MultiWriter(os.Stdout, startup.Console)
+	if err := cmd.Start(); err != nil {
+		return nil, logex.Trace(err)
+	}
+	exited := make(chan struct{})
+	go func() {
+		cmd.Wait()
+		close(exited)
+	}()
+	startup.Exited = func() (bool, error) {
+		select {
+		case <-exited:
+			return true, nil
+		default:
+			return false, nil
+		}
 	}
+	return func(kill func()) {
+		// the worker keeps serving after the build, so stop it explicitly
+		if kill != nil {
+			kill()
+		}
+		cmd.Process.Kill()
+		<-exited
+	}, nil
 }
 
 func (b *BuildToolBuild) RunServer() (func() error, error) {
-	uri, err := url.Parse(b.Listen)
+	listen := b.Listen
+	if listen == "" {
+		listen = "tcp://127.0.0.1:0"
+		if b.Mode() == NitroBuildMode {
+			// a port of its own, the builds of the pool run side by side
+			listen = "vsock://:0"
+		}
+	}
+	uri, err := url.Parse(listen)
 	if err != nil {
 		return nil, logex.Trace(err)
 	}
@@ -249,12 +660,28 @@ func (b *BuildToolBuild) RunServer() (func() error, error) {
 	if err != nil {
 		return nil, logex.Trace(err)
 	}
+	// the worker pins the certificate through the attested channel
+	cert, err := misc.NewRATLSCertificate(nil)
+	if err != nil {
+		listener.Close()
+		return nil, logex.Trace(err)
+	}
+	b.logCert = misc.CertFingerprint(cert.Certificate[0])
+	b.logURI, err = misc.ListenerURI(uri, listener)
+	if err != nil {
+		listener.Close()
+		return nil, logex.Trace(err)
+	}
 
 	b.Server = &http.Server{
 		Addr:    uri.Host,
 		Handler: b,
 	}
 
+	listener = tls.NewListener(listener, &tls.Config{
+		Certificates: []tls.Certificate{*cert},
+		MinVersion:   tls.VersionTLS12,
+	})
 	return func() error {
 		defer listener.Close()
 		if err := b.Server.Serve(listener); err != nil {
@@ -266,13 +693,237 @@ func (b *BuildToolBuild) RunServer() (func() error, error) {
 	}, nil
 }
 
-func checkResponseError(response *http.Response) error {
-	if response.StatusCode != 200 {
-		body, err := io.ReadAll(response.Body)
+// initVerifier requires the worker to present a public key attested by an
+// enclave booted from the -nitro image, nothing is uploaded otherwise.
+func (b *BuildToolBuild) initVerifier(verifier *misc.RATLSVerifier) error {
+	verifier.Required = true
+	pcrs := map[uint]string{0: b.Pcr0, 1: b.Pcr1, 2: b.Pcr2}
+	if b.Pcr0 == "" {
+		measurements, err := misc.DescribeEif(b.Nitro)
 		if err != nil {
 			return logex.Trace(err)
 		}
-		return logex.NewErrorf("%s", body)
+		pcrs[0] = measurements.PCR0
+		if b.Pcr1 == "" {
+			pcrs[1] = measurements.PCR1
+		}
+		if b.Pcr2 == "" {
+			pcrs[2] = measurements.PCR2
+		}
+	}
+	expected, err := misc.ParsePCRs(pcrs)
+	if err != nil {
+		return logex.Trace(err)
+	}
+	verifier.PCRs = expected
+	if b.Debug {
+		// debug enclaves report zeroed PCRs
+		logex.Warn("debug mode: the PCRs of the worker are not checked")
+		verifier.SkipPCRs = true
+	}
+	return nil
+}
+
+// buildPartFiles are the suffixes appended to -output for the parts of the
+// build response.
+var buildPartFiles = map[string]string{
+	api.PartReport:     ".report",
+	api.PartProvenance: ".provenance.json",
+	api.PartProofs:     ".proofs.json",
+	api.PartTranscript: ".transcript.log",
+}
+
+// buildPartFile names the file of a part, the parts of a matrix variant are
+// suffixed by its name, e.g. "output.arm64" is saved to <output>.arm64.tar.
+func buildPartFile(output, name string) (string, error) {
+	if idx := strings.IndexByte(name, '.'); idx >= 0 {
+		variant := name[idx+1:]
+		if variant == "" || strings.ContainsAny(variant, `./\`) {
+			return "", logex.NewErrorf("invalid part name: %q", name)
+		}
+		name, output = name[:idx], output+"."+variant
+	}
+	if name == api.PartOutput {
+		return output + ".tar", nil
+	}
+	if strings.HasPrefix(name, api.PartProofs+"-") {
+		return output + "." + name + ".json", nil
+	}
+	if suffix, ok := buildPartFiles[name]; ok {
+		return output + suffix, nil
+	}
+	return output + "." + name, nil
+}
+
+// verifyInputHashes compares the roots of the source on the host with the
+// attested ones, there are none without the hash cache.
+func verifyInputHashes(local, attested map[misc.HashAlgorithm]string) error {
+	for algorithm, hash := range local {
+		if attested[algorithm] != hash {
+			return logex.NewErrorf("input hash mismatch(%v): attested %v, local %v", algorithm, attested[algorithm], hash)
+		}
+	}
+	return nil
+}
+
+// verifyBuildParts checks the received parts against the digests in the
+// attestation report. The output hash of a matrix build is the root over
+// the output hashes of its variants, which are taken from the provenance.
+func verifyBuildParts(parts map[string]string, report *misc.AttestationReport) error {
+	for _, name := range []string{api.PartProvenance, api.PartTranscript} {
+		if parts[name] == "" {
+			return logex.NewErrorf("missing %v in the build response", name)
+		}
+	}
+	provenance, err := os.ReadFile(parts[api.PartProvenance])
+	if err != nil {
+		return logex.Trace(err)
+	}
+	if hash := build.ProvenanceHash(provenance); hash != report.ProvenanceHash {
+		return logex.NewErrorf("provenance hash mismatch: got %v, attested %v", hash, report.ProvenanceHash)
+	}
+
+	transcriptHash, err := misc.FileSha256(parts[api.PartTranscript])
+	if err != nil {
+		return logex.Trace(err)
+	}
+	if transcriptHash != report.LogHash {
+		return logex.NewErrorf("transcript hash mismatch: got %v, attested %v", transcriptHash, report.LogHash)
+	}
+
+	var record build.Provenance
+	if err := json.Unmarshal(provenance, &record); err != nil {
+		return logex.Trace(err)
+	}
+	if report.InputHashes[report.HashAlgorithm] != report.InputHash ||
+		report.OutputHashes[report.HashAlgorithm] != report.OutputHash {
+		return logex.NewErrorf("the %v roots differ from the attested hashes", report.HashAlgorithm)
+	}
+	// the downloaded files are hashed again, the proofs only show their
+	// leaves are under the attested roots
+	algorithms := make([]misc.HashAlgorithm, 0, len(report.OutputHashes))
+	for algorithm := range report.OutputHashes {
+		algorithms = append(algorithms, algorithm)
+	}
+	outputs := []string{api.PartOutput}
+	if len(record.Matrix) > 0 {
+		outputs = outputs[:0]
+		for _, variant := range record.Matrix {
+			outputs = append(outputs, api.PartOutput+"."+variant.Name)
+		}
+	}
+	leaves := make(map[string]map[string][][]byte, len(outputs))
+	for _, name := range outputs {
+		if parts[name] == "" {
+			return logex.NewErrorf("missing %v in the build response", name)
+		}
+		leaves[name], err = misc.TarLeaves(parts[name], algorithms)
+		if err != nil {
+			return logex.Trace(err, name)
+		}
+	}
+
+	for idx, algorithm := range algorithms {
+		outputHash := report.OutputHashes[algorithm]
+		proofsPart := api.ProofsPart(string(algorithm), algorithm == report.HashAlgorithm)
+		if len(record.Matrix) == 0 {
+			if err := verifyProofs(parts[proofsPart], algorithm, outputHash, report.LeafVersion, leaves[api.PartOutput], idx); err != nil {
+				return logex.Trace(err, algorithm)
+			}
+			continue
+		}
+		roots := make([][]byte, 0, len(record.Matrix))
+		for _, variant := range record.Matrix {
+			variantHash := variant.OutputHashes[algorithm]
+			variantLeaves := leaves[api.PartOutput+"."+variant.Name]
+			if err := verifyProofs(parts[proofsPart+"."+variant.Name], algorithm, variantHash, report.LeafVersion, variantLeaves, idx); err != nil {
+				return logex.Trace(err, variant.Name)
+			}
+			root, err := hex.DecodeString(strings.TrimPrefix(variantHash, "0x"))
+			if err != nil {
+				return logex.Trace(err, variant.Name)
+			}
+			roots = append(roots, root)
+		}
+		root, err := misc.CombineRoots(algorithm, roots)
+		if err != nil {
+			return logex.Trace(err)
+		}
+		if hash := fmt.Sprintf("0x%x", root); hash != outputHash {
+			return logex.NewErrorf("%v matrix root mismatch: got %v, attested %v", algorithm, hash, outputHash)
+		}
+	}
+	return nil
+}
+
+// verifyProofs checks the proofs file fp against the output hash of the
+// algorithm and the attested leaf encoding, and the proved leaves against
+// the leaves of the received files, leafIdx selects the algorithm in them.
+func verifyProofs(fp string, algorithm misc.HashAlgorithm, outputHash string, leafVersion int, leaves map[string][][]byte, leafIdx int) error {
+	if fp == "" {
+		return logex.NewErrorf("missing %v proofs in the build response", algorithm)
+	}
+	data, err := os.ReadFile(fp)
+	if err != nil {
+		return logex.Trace(err)
+	}
+	var proofs misc.MerkleProofs
+	if err := json.Unmarshal(data, &proofs); err != nil {
+		return logex.Trace(err)
+	}
+	if proofs.Algorithm != algorithm {
+		return logex.NewErrorf("proofs algorithm mismatch: got %v, expect %v", proofs.Algorithm, algorithm)
+	}
+	if proofs.Root != outputHash {
+		return logex.NewErrorf("proofs root mismatch: got %v, attested %v", proofs.Root, outputHash)
+	}
+	if proofs.LeafVersion != leafVersion {
+		return logex.NewErrorf("leaf version mismatch: got %v, attested %v", proofs.LeafVersion, leafVersion)
+	}
+	if err := proofs.Verify(); err != nil {
+		return logex.Trace(err)
+	}
+	// every file is proved exactly once at its own index
+	if len(proofs.Files) != len(leaves) {
+		return logex.NewErrorf("the output has %v files, the proofs have %v", len(leaves), len(proofs.Files))
+	}
+	files := make(map[string]bool, len(proofs.Files))
+	indexes := make(map[uint64]bool, len(proofs.Files))
+	for _, file := range proofs.Files {
+		if files[file.File] {
+			return logex.NewErrorf("%v is proved twice", file.File)
+		}
+		files[file.File] = true
+		if indexes[file.Index] || file.Index >= uint64(len(proofs.Files)) {
+			return logex.NewErrorf("invalid leaf index %v of %v", file.Index, file.File)
+		}
+		indexes[file.Index] = true
+		leaf, ok := leaves[file.File]
+		if !ok {
+			return logex.NewErrorf("missing %v in the output", file.File)
+		}
+		if hash := "0x" + hex.EncodeToString(leaf[leafIdx]); hash != file.Leaf {
+			return logex.NewErrorf("output file %v mismatch: got %v, proved %v", file.File, hash, file.Leaf)
+		}
+	}
+	return nil
+}
+
+func (b *BuildToolBuild) checkResources(resources *build.Resources) error {
+	allocator := b.Allocator
+	if allocator == "" {
+		allocator = misc.NitroAllocatorConfig
+	}
+	alloc, err := misc.ReadNitroAllocator(allocator)
+	if err != nil {
+		return logex.Trace(err)
+	}
+	if err := alloc.Check(resources.Cpus, resources.Memory); err != nil {
+		return logex.Trace(err)
+	}
+	// the enclave has no disk, the workspace lives in its memory
+	if resources.Workspace >= resources.Memory {
+		return logex.NewErrorf("workspace(%vMiB) doesn't fit into the enclave memory(%vMiB)", resources.Workspace, resources.Memory)
 	}
 	return nil
 }
@@ -1,25 +1,68 @@
 package build
 
 import (
+	"context"
 	"encoding/hex"
+	"fmt"
 	"os"
+	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/automata-network/tee-compile/misc"
 	"github.com/chzyer/logex"
 )
 
 type Builder struct {
+	Dir             string
 	Manifest        *Manifest
 	Nonce           string
 	GitInfo         *misc.GitInfo
 	OutputResult    *misc.MerkleTreeResult
 	InputResult     *misc.MerkleTreeResult
 	OutputMrenclave string
-	logOutput       *misc.LogOutput
+	Provenance      *Provenance
+	// BaseEnv is the environment the manifest env applies to
+	BaseEnv []string
+	// HashAlgorithms computes a root for each, the first one is attested
+	// as the input and output hash.
+	HashAlgorithms []misc.HashAlgorithm
+	// HashWorkers hashes the files in parallel, one per cpu by default
+	HashWorkers  int
+	InputResults []*misc.MerkleTreeResult
+	// Outputs has an output set per matrix variant, or a single unnamed
+	// one. OutputRoot is the hash attested for them, OutputRoots has the
+	// root of every algorithm.
+	Outputs     []*BuildOutput
+	OutputRoot  []byte
+	OutputRoots [][]byte
+	variant     *MatrixVariant
+	logOutput   *misc.LogOutput
+	logger      *logex.Logger
 }
 
-func NewBuilder(manifest *Manifest, nonce string, logOutput *misc.LogOutput) *Builder {
-	return &Builder{Manifest: manifest, Nonce: nonce, logOutput: logOutput}
+// BuildOutput is an output set, Result is the tree of the first hash
+// algorithm and Results has them all.
+type BuildOutput struct {
+	Name      string
+	Dir       string
+	Result    *misc.MerkleTreeResult
+	Results   []*misc.MerkleTreeResult
+	Mrenclave string
+}
+
+func NewBuilder(dir string, manifest *Manifest, nonce string, logOutput *misc.LogOutput) *Builder {
+	return &Builder{
+		Dir:        dir,
+		Manifest:   manifest,
+		Nonce:      nonce,
+		Provenance: &Provenance{},
+		BaseEnv:    DefaultBaseEnv,
+		logOutput:  logOutput,
+		logger:     logOutput.Logger(),
+
+		HashAlgorithms: []misc.HashAlgorithm{misc.HashKeccak256},
+	}
 }
 
 func (b *Builder) Vendor() error {
@@ -28,7 +71,7 @@ func (b *Builder) Vendor() error {
 		return logex.NewErrorf("unknown language=%q for vendor", b.Manifest.Language)
 	}
 
-	if err := b.build(b.Manifest.Input.Vendor); err != nil {
+	if err := b.runSteps([]*ManifestStep{{Name: "vendor", Cmd: b.Manifest.Input.Vendor}}); err != nil {
 		return logex.Trace(err)
 	}
 
@@ -38,61 +81,282 @@ func (b *Builder) Vendor() error {
 	return nil
 }
 
-func (b *Builder) build(vendor string) error {
-	cwd, err := os.Getwd()
+// runSteps runs the steps in order and stops at the first failure, every
+// step which ran is recorded in the provenance.
+func (b *Builder) runSteps(steps []*ManifestStep) error {
+	b.logger.Infof("cwd: %s", b.workdir())
+	env, err := b.Env()
 	if err != nil {
 		return logex.Trace(err)
 	}
+	for idx, step := range steps {
+		progress := fmt.Sprintf("[step %v/%v %v]", idx+1, len(steps), step.Name)
+		b.logger.Infof("%v running cmd: %q", progress, step.Cmd)
+		record, err := b.runStep(step, env)
+		b.Provenance.Steps = append(b.Provenance.Steps, record)
+		if err != nil {
+			b.logger.Errorf("%v failed after %v: %v", progress, record.Duration, err)
+			return logex.Trace(err, step.Name)
+		}
+		b.logger.Infof("%v finished in %v", progress, record.Duration)
+	}
+	return nil
+}
 
-	logex.Infof("cwd: %s", cwd)
-	cmd := b.Manifest.Input.Cmd
-	if vendor != "" {
-		cmd = vendor
+func (b *Builder) runStep(step *ManifestStep, env []string) (*StepRecord, error) {
+	record := &StepRecord{
+		Name:      step.Name,
+		Cmd:       step.Cmd,
+		Workdir:   step.Workdir,
+		Env:       step.Env,
+		Timeout:   step.Timeout,
+		StartedAt: time.Now().UTC(),
+		ExitCode:  -1,
 	}
-	logex.Infof("running cmd: %q", cmd)
-	if err := misc.Exec(b.logOutput, "bash", "-c", cmd); err != nil {
+	err := func() error {
+		timeout, err := step.ParseTimeout()
+		if err != nil {
+			return logex.Trace(err)
+		}
+		dir := filepath.Join(b.workdir(), step.Workdir)
+		if !misc.IsSubPath(b.Dir, dir) {
+			return logex.NewErrorf("workdir %q is outside of the source", step.Workdir)
+		}
+		if err := CheckEnv(step.Env); err != nil {
+			return logex.Trace(err)
+		}
+		record.ExitCode, err = misc.ExecWith(b.logOutput, &misc.ExecOption{
+			Dir:     dir,
+			Env:     MergeEnv(env, step.Env),
+			Timeout: timeout,
+		}, "bash", "-c", step.Cmd)
 		return logex.Trace(err)
+	}()
+	record.FinishedAt = time.Now().UTC()
+	record.Duration = record.FinishedAt.Sub(record.StartedAt).Round(time.Millisecond).String()
+	if err != nil {
+		record.Error = err.Error()
 	}
-	return nil
+	return record, err
+}
+
+// Env returns the environment of the build commands, it's recorded in the
+// provenance.
+func (b *Builder) Env() ([]string, error) {
+	if err := CheckEnv(b.Manifest.Input.Env); err != nil {
+		return nil, logex.Trace(err)
+	}
+	env := MergeEnv(b.BaseEnv, b.Manifest.Input.Env)
+	if b.variant != nil {
+		env = MergeEnv(env, b.variant.Env)
+	}
+	b.Provenance.Env = env
+	return env, nil
 }
 
 func (b *Builder) Build() error {
-	gitInfo, err := misc.GetGitInfo(".")
+	gitInfo, err := misc.GetGitInfo(b.Dir)
 	if err != nil {
 		return logex.Trace(err)
 	}
-	inputResult, err := misc.FilesMerkleTree([]string{"."}, 10, nil)
+	inputResults, err := misc.FilesMerkleTrees(context.Background(), b.Dir, b.Manifest.Input.HashPaths(), b.HashAlgorithms, b.HashWorkers, nil, nil)
 	if err != nil {
 		return logex.Trace(err)
 	}
+	b.GitInfo = gitInfo
+	b.InputResult = inputResults[0]
+	b.InputResults = inputResults
 
-	if err := b.build(""); err != nil {
-		return logex.Trace(err)
+	if len(b.Manifest.Matrix) > 0 {
+		if err := b.buildMatrix(); err != nil {
+			return logex.Trace(err)
+		}
+		return nil
 	}
 
-	outputResult, err := misc.FilesMerkleTree(b.Manifest.Output.Files, 10, nil)
+	output, err := b.buildOutput()
 	if err != nil {
 		return logex.Trace(err)
 	}
+	b.OutputResult = output.Result
+	b.OutputMrenclave = output.Mrenclave
+	b.Outputs = []*BuildOutput{output}
+	b.OutputRoot = output.Result.Root
+	for _, result := range output.Results {
+		b.OutputRoots = append(b.OutputRoots, result.Root)
+	}
+	return nil
+}
+
+// workdir is the manifest workdir under the source root.
+func (b *Builder) workdir() string {
+	return filepath.Join(b.Dir, filepath.FromSlash(b.Manifest.Workdir))
+}
+
+// buildOutput runs the steps in the workdir and collects the output files.
+func (b *Builder) buildOutput() (*BuildOutput, error) {
+	steps, err := b.Manifest.Input.BuildSteps()
+	if err != nil {
+		return nil, logex.Trace(err)
+	}
+	if err := b.runSteps(steps); err != nil {
+		return nil, logex.Trace(err)
+	}
+
+	files := b.Manifest.Output.Files
+	sgxSignedSo := b.Manifest.Output.SgxSignedSo
+	if b.variant != nil {
+		env := make(map[string]string)
+		for _, item := range b.Provenance.Env {
+			idx := strings.IndexByte(item, '=')
+			env[item[:idx]] = item[idx+1:]
+		}
+		expand := func(s string) string {
+			return os.Expand(s, func(key string) string { return env[key] })
+		}
+		files = make([]*OutputFile, len(b.Manifest.Output.Files))
+		for idx, file := range b.Manifest.Output.Files {
+			files[idx] = &OutputFile{Src: expand(file.Src), Dst: expand(file.Dst)}
+		}
+		sgxSignedSo = expand(sgxSignedSo)
+	}
 
-	if b.Manifest.Output.SgxSignedSo != "" {
-		mrenclave, err := misc.GetMrEnclave(b.Manifest.Output.SgxSignedSo)
+	output := &BuildOutput{Dir: b.workdir()}
+	if b.variant != nil {
+		output.Name = b.variant.Name
+	}
+	mappings, err := ResolveOutputs(output.Dir, files)
+	if err != nil {
+		return nil, logex.Trace(err)
+	}
+	output.Results, err = misc.MappedMerkleTrees(context.Background(), output.Dir, mappings, b.HashAlgorithms, b.HashWorkers, nil)
+	if err != nil {
+		return nil, logex.Trace(err)
+	}
+	output.Result = output.Results[0]
+
+	if sgxSignedSo != "" {
+		mrenclave, err := misc.GetMrEnclave(filepath.Join(output.Dir, sgxSignedSo))
 		if err != nil {
+			return nil, logex.Trace(err)
+		}
+		output.Mrenclave = "0x" + hex.EncodeToString(mrenclave)
+	}
+	return output, nil
+}
+
+// buildMatrix builds every variant against its own copy of the pristine
+// source, the copies are made before any variant runs.
+func (b *Builder) buildMatrix() error {
+	if err := b.Manifest.CheckMatrix(); err != nil {
+		return logex.Trace(err)
+	}
+	if _, err := b.Env(); err != nil {
+		return logex.Trace(err)
+	}
+	matrixDir := filepath.Join(filepath.Dir(b.Dir), "matrix")
+	var builders []*Builder
+	for _, variant := range b.Manifest.Matrix {
+		dir := filepath.Join(matrixDir, variant.Name)
+		if err := os.MkdirAll(matrixDir, 0755); err != nil {
+			return logex.Trace(err)
+		}
+		if err := misc.Exec(b.logOutput, "cp", "-a", b.Dir, dir); err != nil {
 			return logex.Trace(err)
 		}
-		b.OutputMrenclave = "0x" + hex.EncodeToString(mrenclave)
+		builders = append(builders, &Builder{
+			Dir:        dir,
+			Manifest:   b.Manifest,
+			Nonce:      b.Nonce,
+			Provenance: &Provenance{},
+			BaseEnv:    b.BaseEnv,
+			variant:    variant,
+			logOutput:  b.logOutput,
+			logger:     b.logger,
+
+			HashAlgorithms: b.HashAlgorithms,
+			HashWorkers:    b.HashWorkers,
+		})
 	}
 
-	b.GitInfo = gitInfo
-	b.InputResult = inputResult
-	b.OutputResult = outputResult
+	// roots[i] has the variant roots of the i-th algorithm
+	roots := make([][][]byte, len(b.HashAlgorithms))
+	for idx, vb := range builders {
+		b.logger.Infof("[matrix %v/%v %v] building", idx+1, len(builders), vb.variant.Name)
+		output, err := vb.buildOutput()
+		b.Provenance.Matrix = append(b.Provenance.Matrix, &VariantRecord{
+			Name:  vb.variant.Name,
+			Env:   vb.variant.Env,
+			Steps: vb.Provenance.Steps,
+		})
+		if err != nil {
+			return logex.Trace(err, vb.variant.Name)
+		}
+		record := b.Provenance.Matrix[idx]
+		record.OutputHash = fmt.Sprintf("0x%x", output.Result.Root)
+		record.OutputHashes = make(map[misc.HashAlgorithm]string)
+		for i, result := range output.Results {
+			record.OutputHashes[result.Algorithm] = fmt.Sprintf("0x%x", result.Root)
+			roots[i] = append(roots[i], result.Root)
+		}
+		record.Mrenclave = output.Mrenclave
+		b.Outputs = append(b.Outputs, output)
+	}
+	for i, algorithm := range b.HashAlgorithms {
+		root, err := misc.CombineRoots(algorithm, roots[i])
+		if err != nil {
+			return logex.Trace(err)
+		}
+		b.OutputRoots = append(b.OutputRoots, root)
+	}
+	b.OutputRoot = b.OutputRoots[0]
 	return nil
 }
 
-func (b *Builder) Tar() (string, error) {
-	tarFile, err := misc.Tar(b.logOutput, "output", b.OutputResult.FileList)
+// tarOutput packs the output files under their published names, the mapped
+// ones are linked into a staging directory first.
+func (b *Builder) tarOutput(output *BuildOutput, dir, tag string) (string, error) {
+	result := output.Result
+	if !result.Mapped() {
+		return misc.TarTo(b.logOutput, output.Dir, dir, tag, result.FileList)
+	}
+	stage, err := os.MkdirTemp(dir, "publish-*")
+	if err != nil {
+		return "", logex.Trace(err)
+	}
+	defer os.RemoveAll(stage)
+	for idx, dst := range result.FileList {
+		fp := filepath.Join(stage, filepath.FromSlash(dst))
+		if err := os.MkdirAll(filepath.Dir(fp), 0755); err != nil {
+			return "", logex.Trace(err)
+		}
+		if err := os.Link(filepath.Join(output.Dir, filepath.FromSlash(result.Sources[idx])), fp); err != nil {
+			return "", logex.Trace(err)
+		}
+	}
+	tarFile, err := misc.TarTo(b.logOutput, stage, dir, tag, result.FileList)
 	if err != nil {
 		return "", logex.Trace(err)
 	}
 	return tarFile, nil
 }
+
+// Tar packs every output set into its own tarball under dir.
+func (b *Builder) Tar(dir string) ([]string, error) {
+	var tarFiles []string
+	for _, output := range b.Outputs {
+		tag := "output"
+		if output.Name != "" {
+			tag += "-" + output.Name
+		}
+		tarFile, err := b.tarOutput(output, dir, tag)
+		if err != nil {
+			for _, fp := range tarFiles {
+				os.Remove(fp)
+			}
+			return nil, logex.Trace(err)
+		}
+		tarFiles = append(tarFiles, tarFile)
+	}
+	return tarFiles, nil
+}
@@ -0,0 +1,82 @@
+package build
+
+import (
+	"bufio"
+	"os"
+	"strings"
+
+	"github.com/chzyer/logex"
+)
+
+// BaseEnvFile lists the environment of the image toolchain, one KEY=VALUE
+// per line. It's part of the image, so it's covered by the measurement.
+const BaseEnvFile = "/etc/tee-compile/env"
+
+// DefaultBaseEnv is the environment a build starts from when the image has
+// no BaseEnvFile.
+var DefaultBaseEnv = []string{
+	"PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin",
+	"HOME=/root",
+	"LANG=C.UTF-8",
+	"LC_ALL=C.UTF-8",
+	"TZ=UTC",
+}
+
+// LoadBaseEnv reads the base environment from fp, DefaultBaseEnv is used
+// if it doesn't exist. Empty lines and lines starting with # are skipped.
+func LoadBaseEnv(fp string) ([]string, error) {
+	fd, err := os.Open(fp)
+	if os.IsNotExist(err) {
+		return DefaultBaseEnv, nil
+	}
+	if err != nil {
+		return nil, logex.Trace(err)
+	}
+	defer fd.Close()
+	var env []string
+	scanner := bufio.NewScanner(fd)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		env = append(env, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, logex.Trace(err)
+	}
+	if err := CheckEnv(env); err != nil {
+		return nil, logex.Trace(err, fp)
+	}
+	return env, nil
+}
+
+func CheckEnv(env []string) error {
+	for _, item := range env {
+		if idx := strings.IndexByte(item, '='); idx <= 0 {
+			return logex.NewErrorf("invalid env %q, expect KEY=VALUE", item)
+		}
+	}
+	return nil
+}
+
+// MergeEnv applies the overrides to base, a key keeps the position of its
+// first appearance. The items must have passed CheckEnv.
+func MergeEnv(base []string, overrides ...[]string) []string {
+	var keys []string
+	values := make(map[string]string)
+	for _, env := range append([][]string{base}, overrides...) {
+		for _, item := range env {
+			key := item[:strings.IndexByte(item, '=')]
+			if _, ok := values[key]; !ok {
+				keys = append(keys, key)
+			}
+			values[key] = item
+		}
+	}
+	ret := make([]string, 0, len(keys))
+	for _, key := range keys {
+		ret = append(ret, values[key])
+	}
+	return ret
+}
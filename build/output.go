@@ -0,0 +1,121 @@
+package build
+
+import (
+	"encoding/json"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/automata-network/tee-compile/misc"
+	"github.com/chzyer/logex"
+)
+
+// OutputFile is an entry of output.files, either a pattern or an object
+// publishing the files matched by Src under Dst. When Src names a single
+// file Dst is its new name, unless Dst ends with "/". Otherwise Dst is a
+// directory receiving the matched files by their path under the part of
+// Src before the first wildcard.
+type OutputFile struct {
+	Src string `json:"src"`
+	Dst string `json:"dst,omitempty"`
+}
+
+func (f *OutputFile) UnmarshalJSON(data []byte) error {
+	if err := json.Unmarshal(data, &f.Src); err == nil {
+		return nil
+	}
+	type outputFile OutputFile
+	if err := json.Unmarshal(data, (*outputFile)(f)); err != nil {
+		return logex.Trace(err)
+	}
+	if f.Src == "" {
+		return logex.NewErrorf("output file without src: %s", data)
+	}
+	return nil
+}
+
+func (f *OutputFile) MarshalJSON() ([]byte, error) {
+	if f.Dst == "" {
+		return json.Marshal(f.Src)
+	}
+	type outputFile OutputFile
+	return json.Marshal((*outputFile)(f))
+}
+
+// ResolveOutputs matches the output files under root and names each by
+// where it's published. The exclusions apply to every entry.
+func ResolveOutputs(root string, files []*OutputFile) ([]*misc.FileMapping, error) {
+	for _, file := range files {
+		if strings.HasPrefix(file.Src, "!") && file.Dst != "" {
+			return nil, logex.NewErrorf("exclusion %q can't have a dst", file.Src)
+		}
+	}
+
+	// all the entries are found in one walk, each along with the exclusions
+	patterns := make([]string, len(files))
+	for idx, file := range files {
+		patterns[idx] = file.Src
+	}
+	matches := make([][]string, len(files))
+	if err := misc.WalkGlobMatches(root, patterns, func(fp string, indexes []int) error {
+		for _, idx := range indexes {
+			matches[idx] = append(matches[idx], fp)
+		}
+		return nil
+	}); err != nil {
+		return nil, logex.Trace(err)
+	}
+
+	published := make(map[string]string)
+	var mappings []*misc.FileMapping
+	for idx, file := range files {
+		sort.Strings(matches[idx])
+		for _, src := range matches[idx] {
+			dst, err := file.publish(src)
+			if err != nil {
+				return nil, logex.Trace(err)
+			}
+			if published[dst] == src {
+				continue
+			}
+			published[dst] = src
+			mappings = append(mappings, &misc.FileMapping{Src: src, Dst: dst})
+		}
+	}
+	return mappings, nil
+}
+
+func (f *OutputFile) publish(src string) (string, error) {
+	if f.Dst == "" {
+		return src, nil
+	}
+	base := patternBase(f.Src)
+	var dst string
+	switch {
+	case src == base && strings.HasSuffix(f.Dst, "/"):
+		dst = path.Join(f.Dst, path.Base(src))
+	case src == base:
+		dst = f.Dst
+	case base == "":
+		dst = path.Join(f.Dst, src)
+	default:
+		dst = path.Join(f.Dst, strings.TrimPrefix(src, base+"/"))
+	}
+	if dst == "." || !isRelPath(dst) {
+		return "", logex.NewErrorf("invalid dst %q of %v", f.Dst, src)
+	}
+	return dst, nil
+}
+
+// patternBase returns the leading segments of the pattern without
+// wildcards.
+func patternBase(pattern string) string {
+	var base []string
+	for _, part := range strings.Split(path.Clean(pattern), "/") {
+		if part == "." || strings.ContainsAny(part, `*?[\`) {
+			break
+		}
+		base = append(base, part)
+	}
+	return strings.Join(base, "/")
+}
@@ -0,0 +1,62 @@
+package build
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/automata-network/tee-compile/misc"
+	"github.com/chzyer/logex"
+)
+
+// Provenance records how the build was done. It's too large for the
+// attestation user data, so only its hash is attested.
+type Provenance struct {
+	Resources *Resources `json:"resources,omitempty"`
+	Enclave   *Resources `json:"enclave,omitempty"`
+	// Env is the effective environment of the build commands
+	Env   []string      `json:"env,omitempty"`
+	Steps []*StepRecord `json:"steps,omitempty"`
+	// Matrix lists the variants of a matrix build, the attested output
+	// hash is the merkle root over their output hashes in order.
+	Matrix []*VariantRecord `json:"matrix,omitempty"`
+}
+
+// VariantRecord is a variant of a matrix build, OutputHash is the root of
+// the first hash algorithm and OutputHashes has the root of every one.
+type VariantRecord struct {
+	Name         string                        `json:"name"`
+	Env          []string                      `json:"env,omitempty"`
+	OutputHash   string                        `json:"output_hash"`
+	OutputHashes map[misc.HashAlgorithm]string `json:"output_hashes,omitempty"`
+	Mrenclave    string                        `json:"mrenclave,omitempty"`
+	Steps        []*StepRecord                 `json:"steps,omitempty"`
+}
+
+// StepRecord is how a step ran, Env only lists the step overrides of
+// Provenance.Env.
+type StepRecord struct {
+	Name       string    `json:"name"`
+	Cmd        string    `json:"cmd"`
+	Workdir    string    `json:"workdir,omitempty"`
+	Env        []string  `json:"env,omitempty"`
+	Timeout    string    `json:"timeout,omitempty"`
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+	Duration   string    `json:"duration"`
+	ExitCode   int       `json:"exit_code"`
+	Error      string    `json:"error,omitempty"`
+}
+
+func (p *Provenance) Encode() ([]byte, error) {
+	data, err := json.Marshal(p)
+	if err != nil {
+		return nil, logex.Trace(err)
+	}
+	return data, nil
+}
+
+func ProvenanceHash(data []byte) string {
+	return fmt.Sprintf("0x%x", sha256.Sum256(data))
+}
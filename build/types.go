@@ -1,37 +1,236 @@
 package build
 
 import (
+	"crypto/sha256"
 	"encoding/json"
+	"fmt"
 	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
 
 	"github.com/chzyer/logex"
 )
 
+// DefaultManifest is the manifest path used when none is given.
+const DefaultManifest = "build.json"
+
 type Manifest struct {
-	Language string          `json:"language"`
-	Input    *ManifestInput  `json:"input"`
-	Output   *ManifestOutput `json:"output"`
+	Language  string           `json:"language"`
+	Input     *ManifestInput   `json:"input"`
+	Output    *ManifestOutput  `json:"output"`
+	Resources *Resources       `json:"resources,omitempty"`
+	Matrix    []*MatrixVariant `json:"matrix,omitempty"`
+	// Workdir is where the steps run and the output files are looked up,
+	// relative to the source root. It defaults to the manifest directory.
+	Workdir string `json:"workdir,omitempty"`
+	// HashAlgorithms are the merkle root algorithms, keccak256 by default.
+	HashAlgorithms []string `json:"hash_algorithms,omitempty"`
+
+	// Path and Hash identify the manifest file in the source, they are
+	// set by LoadManifest.
+	Path string `json:"-"`
+	Hash string `json:"-"`
+}
+
+// MatrixVariant is one build of a matrix. It runs the input against its
+// own copy of the source with Env on top of the input env, ${VAR} in the
+// output files expands to that env.
+type MatrixVariant struct {
+	Name string   `json:"name"`
+	Env  []string `json:"env,omitempty"`
+}
+
+var variantNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+func (m *Manifest) CheckMatrix() error {
+	names := make(map[string]bool)
+	for idx, variant := range m.Matrix {
+		if !variantNamePattern.MatchString(variant.Name) {
+			return logex.NewErrorf("matrix[%v]: invalid name %q, expect [A-Za-z0-9_-]+", idx, variant.Name)
+		}
+		if names[variant.Name] {
+			return logex.NewErrorf("matrix[%v]: duplicated name %q", idx, variant.Name)
+		}
+		names[variant.Name] = true
+		if err := CheckEnv(variant.Env); err != nil {
+			return logex.Trace(err, variant.Name)
+		}
+	}
+	return nil
+}
+
+// Resources describes what the build requires, memory and workspace are
+// in MiB.
+type Resources struct {
+	Cpus      int `json:"cpus,omitempty"`
+	Memory    int `json:"memory,omitempty"`
+	Workspace int `json:"workspace,omitempty"`
+}
+
+// Override returns a copy of r with the non-zero fields of o applied.
+func (r *Resources) Override(o *Resources) *Resources {
+	ret := &Resources{}
+	if r != nil {
+		*ret = *r
+	}
+	if o == nil {
+		return ret
+	}
+	if o.Cpus != 0 {
+		ret.Cpus = o.Cpus
+	}
+	if o.Memory != 0 {
+		ret.Memory = o.Memory
+	}
+	if o.Workspace != 0 {
+		ret.Workspace = o.Workspace
+	}
+	return ret
 }
 
+// ManifestInput describes how to build. Paths are the files covered by the
+// input hash, relative to the source root, the whole source by default.
 type ManifestInput struct {
-	Cmd    string   `json:"cmd"`
-	Vendor string   `json:"vendor"`
-	Env    []string `json:"env"`
+	Cmd    string          `json:"cmd"`
+	Vendor string          `json:"vendor"`
+	Env    []string        `json:"env"`
+	Steps  []*ManifestStep `json:"steps,omitempty"`
+	Paths  []string        `json:"paths,omitempty"`
+}
+
+// HashPaths returns the patterns of the files covered by the input hash,
+// the git metadata differs between clones and is always left out.
+func (i *ManifestInput) HashPaths() []string {
+	paths := i.Paths
+	if len(paths) == 0 {
+		paths = []string{"."}
+	}
+	return append(paths[:len(paths):len(paths)], "!**/.git")
+}
+
+// ManifestStep is a stage of the build. Workdir is relative to the
+// manifest workdir, Env applies on top of the input env and Timeout is a duration like "10m".
+type ManifestStep struct {
+	Name    string   `json:"name"`
+	Cmd     string   `json:"cmd"`
+	Env     []string `json:"env,omitempty"`
+	Workdir string   `json:"workdir,omitempty"`
+	Timeout string   `json:"timeout,omitempty"`
+}
+
+// BuildSteps returns the steps to run, a plain cmd is a single step.
+func (i *ManifestInput) BuildSteps() ([]*ManifestStep, error) {
+	if len(i.Steps) == 0 {
+		if i.Cmd == "" {
+			return nil, logex.NewErrorf("input.cmd or input.steps is required")
+		}
+		return []*ManifestStep{{Name: "build", Cmd: i.Cmd}}, nil
+	}
+	if i.Cmd != "" {
+		return nil, logex.NewErrorf("input.cmd and input.steps are exclusive")
+	}
+	names := make(map[string]bool)
+	for idx, step := range i.Steps {
+		if step.Name == "" {
+			return nil, logex.NewErrorf("steps[%v]: name is required", idx)
+		}
+		if names[step.Name] {
+			return nil, logex.NewErrorf("steps[%v]: duplicated name %q", idx, step.Name)
+		}
+		names[step.Name] = true
+		if step.Cmd == "" {
+			return nil, logex.NewErrorf("step %q: cmd is required", step.Name)
+		}
+		if err := CheckEnv(step.Env); err != nil {
+			return nil, logex.Trace(err, step.Name)
+		}
+		if _, err := step.ParseTimeout(); err != nil {
+			return nil, logex.Trace(err, step.Name)
+		}
+	}
+	return i.Steps, nil
+}
+
+func (s *ManifestStep) ParseTimeout() (time.Duration, error) {
+	if s.Timeout == "" {
+		return 0, nil
+	}
+	timeout, err := time.ParseDuration(s.Timeout)
+	if err != nil {
+		return 0, logex.Trace(err)
+	}
+	if timeout < 0 {
+		return 0, logex.NewErrorf("negative timeout: %v", s.Timeout)
+	}
+	return timeout, nil
 }
 
 type ManifestOutput struct {
-	SgxSignedSo string   `json:"sgx_signed_so"`
-	Files       []string `json:"files"`
+	SgxSignedSo string        `json:"sgx_signed_so"`
+	Files       []*OutputFile `json:"files"`
+}
+
+// hasFiles reports whether some entry of files isn't an exclusion.
+func (o *ManifestOutput) hasFiles() bool {
+	for _, file := range o.Files {
+		if !strings.HasPrefix(file.Src, "!") {
+			return true
+		}
+	}
+	return false
 }
 
-func NewManifest(file string) (*Manifest, error) {
-	data, err := os.ReadFile(file)
+// LoadManifest reads the manifest at fp, a slash separated path relative to
+// the source root. The manifest paths are checked to stay in the source.
+func LoadManifest(root string, fp string) (*Manifest, error) {
+	if fp == "" {
+		fp = DefaultManifest
+	}
+	clean := path.Clean(fp)
+	if !isRelPath(clean) {
+		return nil, logex.NewErrorf("manifest %q is outside of the source", fp)
+	}
+	data, err := os.ReadFile(filepath.Join(root, filepath.FromSlash(clean)))
 	if err != nil {
-		return nil, logex.Trace(err, file)
+		return nil, logex.Trace(err, fp)
 	}
 	var manifest Manifest
 	if err := json.Unmarshal(data, &manifest); err != nil {
-		return nil, logex.Trace(err)
+		return nil, logex.Trace(err, fp)
+	}
+	manifest.Path = clean
+	manifest.Hash = fmt.Sprintf("0x%x", sha256.Sum256(data))
+
+	if manifest.Workdir == "" {
+		manifest.Workdir = path.Dir(clean)
+	}
+	manifest.Workdir = path.Clean(manifest.Workdir)
+	if !isRelPath(manifest.Workdir) {
+		return nil, logex.NewErrorf("workdir %q is outside of the source", manifest.Workdir)
+	}
+	if manifest.Input == nil {
+		return nil, logex.NewErrorf("manifest %v: input is required", clean)
+	}
+	if _, err := manifest.Input.BuildSteps(); err != nil {
+		return nil, logex.Trace(err, clean)
+	}
+	for _, p := range manifest.Input.Paths {
+		if !isRelPath(path.Clean(p)) {
+			return nil, logex.NewErrorf("input path %q is outside of the source", p)
+		}
+	}
+	// the output hash is a merkle root over the files, sgx_signed_so only
+	// adds the mrenclave of one of them
+	if manifest.Output == nil || !manifest.Output.hasFiles() {
+		return nil, logex.NewErrorf("manifest %v: output.files is required", clean)
 	}
 	return &manifest, nil
 }
+
+// isRelPath reports whether the cleaned slash path stays under its root.
+func isRelPath(p string) bool {
+	return !path.IsAbs(p) && p != ".." && (len(p) < 3 || p[:3] != "../")
+}
@@ -16,15 +16,10 @@ var VendorList = map[string]VendorExecutor{
 type RustVendor struct{}
 
 func (r *RustVendor) Vendor(log *misc.LogOutput) error {
-	if err := misc.InDir("/root", func() error {
-		fp, err := misc.TarTo(log, "/tmp/vendor/", "vendor", []string{".cargo/registry", ".cargo/git"})
-		if err != nil {
-			return logex.Trace(err)
-		}
-		logex.Infof("vendor to %v", fp)
-		return nil
-	}); err != nil {
+	fp, err := misc.TarTo(log, "/root", "/tmp/vendor/", "vendor", []string{".cargo/registry", ".cargo/git"})
+	if err != nil {
 		return logex.Trace(err)
 	}
+	logex.Infof("vendor to %v", fp)
 	return nil
 }
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/automata-network/tee-compile/misc"
+)
+
+// writeTestProofs hashes the files of a fresh tree and returns the leaves
+// the host would compute along with the proofs of the worker.
+func writeTestProofs(t *testing.T, names ...string) (map[string][][]byte, *misc.MerkleProofs) {
+	t.Helper()
+	root := t.TempDir()
+	var mappings []*misc.FileMapping
+	for _, name := range names {
+		if err := os.WriteFile(filepath.Join(root, name), []byte("content of "+name), 0644); err != nil {
+			t.Fatal(err)
+		}
+		mappings = append(mappings, &misc.FileMapping{Src: name, Dst: name})
+	}
+	results, err := misc.MappedMerkleTrees(context.Background(), root, mappings, []misc.HashAlgorithm{misc.HashKeccak256}, 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaves := make(map[string][][]byte)
+	for idx, file := range results[0].FileList {
+		leaves[file] = [][]byte{results[0].Leaves[idx]}
+	}
+	proofs, err := results[0].Proofs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return leaves, proofs
+}
+
+func TestVerifyProofs(t *testing.T) {
+	cases := []struct {
+		name   string
+		modify func(proofs *misc.MerkleProofs)
+		err    string
+	}{
+		{"valid", func(proofs *misc.MerkleProofs) {}, ""},
+		{"duplicated file", func(proofs *misc.MerkleProofs) {
+			// a valid proof of a listed twice, b is never checked
+			dup := *proofs.Files[0]
+			proofs.Files[1] = &dup
+		}, "proved twice"},
+		{"missing file", func(proofs *misc.MerkleProofs) {
+			proofs.Files = proofs.Files[:2]
+		}, "the output has 3 files"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			leaves, proofs := writeTestProofs(t, "a", "b", "c")
+			c.modify(proofs)
+			data, err := json.Marshal(proofs)
+			if err != nil {
+				t.Fatal(err)
+			}
+			fp := filepath.Join(t.TempDir(), "proofs.json")
+			if err := os.WriteFile(fp, data, 0644); err != nil {
+				t.Fatal(err)
+			}
+			err = verifyProofs(fp, misc.HashKeccak256, proofs.Root, misc.LeafVersion, leaves, 0)
+			if c.err == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Fatalf("got error %v, expect %q", err, c.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/automata-network/tee-compile/misc"
+	"github.com/chzyer/logex"
+)
+
+type BuildToolCache struct {
+	Prune *BuildToolCachePrune `flagly:"handler"`
+}
+
+type BuildToolCachePrune struct {
+	File   string        `desc:"file of the hash cache, default to ~/.tee-compile/hashcache.json"`
+	MaxAge time.Duration `default:"720h" desc:"drop the entries unused for this long, 0 keeps them"`
+	All    bool          `desc:"drop all the entries"`
+}
+
+func (h *BuildToolCachePrune) FlaglyHandle() error {
+	cache, err := misc.OpenHashCache(h.File)
+	if err != nil {
+		return logex.Trace(err)
+	}
+	var kept, dropped int
+	if h.All {
+		dropped, err = cache.Clear()
+	} else {
+		kept, dropped, err = cache.Prune(h.MaxAge)
+	}
+	if err != nil {
+		return logex.Trace(err)
+	}
+	fmt.Printf("%v: %v entries kept, %v dropped\n", cache.File, kept, dropped)
+	return nil
+}
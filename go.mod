@@ -10,6 +10,7 @@ require (
 	github.com/mdlayher/vsock v1.2.1
 	github.com/wealdtech/go-merkletree v1.0.0
 	golang.org/x/crypto v0.12.0
+	golang.org/x/sync v0.1.0
 )
 
 require (
@@ -18,6 +19,5 @@ require (
 	github.com/stretchr/testify v1.8.4 // indirect
 	github.com/x448/float16 v0.8.4 // indirect
 	golang.org/x/net v0.10.0 // indirect
-	golang.org/x/sync v0.1.0 // indirect
 	golang.org/x/sys v0.11.0 // indirect
 )
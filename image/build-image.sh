@@ -5,7 +5,8 @@ if [[ "$LANG" == "" ]]; then
 fi
 
 function build_docker() {
-    `cd ../ && CGO_ENABLED=0 go build -o image/ .`
+    VERSION=$(git describe --tags --always --dirty)
+    `cd ../ && CGO_ENABLED=0 go build -ldflags "-X main.Version=$VERSION" -o image/ .`
     docker build --tag ata-build-$LANG -f $LANG/Dockerfile .
 }
 
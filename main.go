@@ -7,12 +7,17 @@ import (
 	"github.com/chzyer/logex"
 )
 
+// Version is set by -ldflags "-X main.Version=..." at release.
+var Version = "dev"
+
 type BuildTool struct {
 	Build  *BuildToolBuild  `flagly:"handler"`
 	Worker *BuildToolWorker `flagly:"handler"`
 	Vendor *BuildToolVendor `flagly:"handler"`
 	SGX    *BuildToolSGX    `flagly:"handler"`
 	Report *BuildToolReport `flagly:"handler"`
+	Pool   *BuildToolPool   `flagly:"handler"`
+	Cache  *BuildToolCache  `flagly:"handler"`
 }
 
 func main() {
@@ -16,24 +16,44 @@ type AttestationReport struct {
 	OutputHash string `json:"output_hash,omitempty"`
 	Nonce      string `json:"nonce,omitempty"`
 	Mrenclave  string `json:"mrenclave,omitempty"`
+
+	ProvenanceHash string `json:"provenance_hash,omitempty"`
+	LogHash        string `json:"log_hash,omitempty"`
+	Manifest       string `json:"manifest,omitempty"`
+	ManifestHash   string `json:"manifest_hash,omitempty"`
+	LeafVersion    int    `json:"leaf_version,omitempty"`
+
+	// HashAlgorithm is the algorithm of InputHash and OutputHash, the
+	// maps have the roots of every algorithm of the build.
+	HashAlgorithm HashAlgorithm            `json:"hash_algorithm,omitempty"`
+	InputHashes   map[HashAlgorithm]string `json:"input_hashes,omitempty"`
+	OutputHashes  map[HashAlgorithm]string `json:"output_hashes,omitempty"`
 }
 
 func Attestation(report *AttestationReport) ([]byte, error) {
-	sess, err := nsm.OpenDefaultSession()
-	if err != nil {
-		return nil, err
-	}
-	defer sess.Close()
-
 	data, err := json.Marshal(report)
 	if err != nil {
 		return nil, logex.Trace(err)
 	}
-
-	res, err := sess.Send(&request.Attestation{
+	return attest(&request.Attestation{
 		UserData: data,
 		Nonce:    []byte(report.Nonce),
 	})
+}
+
+// AttestPublicKey returns an attestation document carrying the public key.
+func AttestPublicKey(pubkey []byte) ([]byte, error) {
+	return attest(&request.Attestation{PublicKey: pubkey})
+}
+
+func attest(req *request.Attestation) ([]byte, error) {
+	sess, err := nsm.OpenDefaultSession()
+	if err != nil {
+		return nil, err
+	}
+	defer sess.Close()
+
+	res, err := sess.Send(req)
 	if err != nil {
 		return nil, err
 	}
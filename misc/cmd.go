@@ -8,6 +8,9 @@ import (
 	"os/exec"
 	"path/filepath"
 	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/chzyer/logex"
 )
@@ -17,37 +20,78 @@ type LogOutput struct {
 	Stderr io.Writer
 }
 
-func Exec(out *LogOutput, name string, args ...string) error {
-	if out == nil {
-		out = &LogOutput{}
-	}
-	if out.Stdout == nil {
-		out.Stdout = os.Stdout
+func (o *LogOutput) withDefault() *LogOutput {
+	ret := &LogOutput{Stdout: os.Stdout, Stderr: os.Stderr}
+	if o != nil && o.Stdout != nil {
+		ret.Stdout = o.Stdout
 	}
-	if out.Stderr == nil {
-		out.Stderr = os.Stderr
+	if o != nil && o.Stderr != nil {
+		ret.Stderr = o.Stderr
 	}
+	return ret
+}
+
+// Exec runs the command in the environment of the process, stdin is
+// always closed.
+func Exec(out *LogOutput, name string, args ...string) error {
+	_, err := ExecWith(out, &ExecOption{}, name, args...)
+	return err
+}
+
+type ExecOption struct {
+	Dir string
+	// Env is the whole environment, nil inherits the one of the process
+	Env []string
+	// Timeout kills the command and all its children, zero never does
+	Timeout time.Duration
+}
+
+// ExecWith runs the command and returns its exit code, which is -1 if it
+// was killed.
+func ExecWith(out *LogOutput, opt *ExecOption, name string, args ...string) (int, error) {
+	out = out.withDefault()
 	fmt.Fprintf(out.Stdout, "exec %q\n", strings.Join(append([]string{name}, args...), " "))
 
 	cmd := exec.Command(name, args...)
+	cmd.Dir = opt.Dir
+	cmd.Env = opt.Env
 	cmd.Stderr = out.Stderr
-	cmd.Stdin = os.Stdin
 	cmd.Stdout = out.Stdout
-	if err := cmd.Run(); err != nil {
-		return logex.Trace(err)
+	if opt.Timeout > 0 {
+		// a process group, so the timeout reaches the children holding the pipes
+		cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	}
+	if err := cmd.Start(); err != nil {
+		return -1, logex.Trace(err)
 	}
+
+	var timedOut int32
+	if opt.Timeout > 0 {
+		timer := time.AfterFunc(opt.Timeout, func() {
+			atomic.StoreInt32(&timedOut, 1)
+			syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		})
+		defer timer.Stop()
+	}
+	err := cmd.Wait()
 	exitCode := cmd.ProcessState.ExitCode()
+	if atomic.LoadInt32(&timedOut) == 1 {
+		return exitCode, logex.NewErrorf("timed out after %v", opt.Timeout)
+	}
+	if _, ok := err.(*exec.ExitError); err != nil && !ok {
+		return exitCode, logex.Trace(err)
+	}
 	if exitCode != 0 {
-		return logex.NewErrorf("exit by code: %v", exitCode)
+		return exitCode, logex.NewErrorf("exit by code: %v", exitCode)
 	}
-	return nil
+	return 0, nil
 }
 
-func Tar(out *LogOutput, prefix string, filelist []string) (string, error) {
-	return TarTo(out, "", prefix, filelist)
+func Tar(out *LogOutput, root, prefix string, filelist []string) (string, error) {
+	return TarTo(out, root, "", prefix, filelist)
 }
 
-func TarTo(out *LogOutput, dir, tag string, filelist []string) (string, error) {
+func TarTo(out *LogOutput, root, dir, tag string, filelist []string) (string, error) {
 	var buf [16]byte
 	if _, err := rand.Read(buf[:]); err != nil {
 		return "", logex.Trace(err)
@@ -57,6 +101,9 @@ func TarTo(out *LogOutput, dir, tag string, filelist []string) (string, error) {
 	}
 	fp := filepath.Join(dir, fmt.Sprintf("%v-%x.tar", tag, buf))
 	args := []string{"cf", fp}
+	if root != "" {
+		args = append(args, "-C", root)
+	}
 	args = append(args, filelist...)
 	if err := Exec(out, "tar", args...); err != nil {
 		os.RemoveAll(fp)
@@ -65,38 +112,12 @@ func TarTo(out *LogOutput, dir, tag string, filelist []string) (string, error) {
 	return fp, nil
 }
 
-func InDir(dir string, run func() error) error {
-	cwd, err := os.Getwd()
-	if err != nil {
+func Untar(out *LogOutput, file, target string) error {
+	if err := os.MkdirAll(target, 0755); err != nil {
 		return logex.Trace(err)
 	}
-	if err := os.Chdir(dir); err != nil {
+	if err := Exec(out, "tar", "xvf", file, "-C", target); err != nil {
 		return logex.Trace(err)
 	}
-	if err := run(); err != nil {
-		return logex.Trace(err)
-	}
-	os.Chdir(cwd)
 	return nil
 }
-
-func RunNitroEnclave(path string, mem string, debug bool) *exec.Cmd {
-	args := []string{
-		"run-enclave",
-		"--cpu-count", "2",
-		"--memory", mem,
-		"--enclave-cid", "11",
-		"--eif-path", path,
-	}
-	if debug {
-		args = append(args,
-			"--debug-mode",
-			"--attach-console",
-		)
-	}
-	cmd := exec.Command("nitro-cli", args...)
-	cmd.Stderr = os.Stderr
-	cmd.Stdin = os.Stdin
-	cmd.Stdout = os.Stdout
-	return cmd
-}
@@ -0,0 +1,32 @@
+package misc
+
+import (
+	"os"
+	"syscall"
+
+	"github.com/chzyer/logex"
+)
+
+// Flock takes an exclusive lock on the file, the returned func releases it.
+func Flock(fp string) (func(), error) {
+	fd, err := os.OpenFile(fp, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, logex.Trace(err)
+	}
+	if err := syscall.Flock(int(fd.Fd()), syscall.LOCK_EX); err != nil {
+		fd.Close()
+		return nil, logex.Trace(err)
+	}
+	return func() {
+		syscall.Flock(int(fd.Fd()), syscall.LOCK_UN)
+		fd.Close()
+	}, nil
+}
+
+func ProcessAlive(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
@@ -1,23 +1,171 @@
 package misc
 
 import (
+	"io/fs"
+	"path"
 	"path/filepath"
-	"sort"
+	"strings"
 
 	"github.com/chzyer/logex"
 )
 
-func GlobSortList(patterns []string) ([]string, error) {
-	var allList []string
-	for _, pattern := range patterns {
-		matches, err := filepath.Glob(pattern)
+// WalkGlob calls fn with the files under root matched by the slash
+// separated patterns as they are found. A "**" segment matches any number
+// of directories, a matched directory brings all the files under it and a
+// pattern starting with "!" excludes what it matches from the others, the
+// excluded directories are not walked. Every pattern that isn't an
+// exclusion must match at least one file.
+func WalkGlob(root string, patterns []string, fn func(fp string) error) error {
+	return WalkGlobMatches(root, patterns, func(fp string, _ []int) error {
+		return fn(fp)
+	})
+}
+
+// WalkGlobMatches is WalkGlob also telling fn the indexes of the patterns
+// matching each file, so several sets of files are found in one walk. The
+// directories no pattern can match are not walked.
+func WalkGlobMatches(root string, patterns []string, fn func(fp string, matches []int) error) error {
+	var includes, excludes []*globPattern
+	var indexes []int
+	for idx, pattern := range patterns {
+		glob, exclude, err := parsePattern(pattern)
 		if err != nil {
-			return nil, logex.Trace(err, pattern)
+			return logex.Trace(err)
+		}
+		if exclude {
+			excludes = append(excludes, glob)
+		} else {
+			includes = append(includes, glob)
+			indexes = append(indexes, idx)
 		}
-		allList = append(allList, matches...)
 	}
-	sort.Slice(allList, func(i, j int) bool {
-		return allList[i] < allList[j]
+
+	matched := make([]bool, len(includes))
+	err := filepath.WalkDir(root, func(fp string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return logex.Trace(err)
+		}
+		rel, err := filepath.Rel(root, fp)
+		if err != nil {
+			return logex.Trace(err)
+		}
+		var parts []string
+		if rel != "." {
+			parts = strings.Split(filepath.ToSlash(rel), "/")
+		}
+		for _, glob := range excludes {
+			// the ancestors were checked when they were walked
+			if matchParts(glob.parts, parts) {
+				if d.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+		}
+		if d.IsDir() {
+			for _, glob := range includes {
+				if glob.matchDir(parts) {
+					return nil
+				}
+			}
+			return filepath.SkipDir
+		}
+		var matches []int
+		for idx, glob := range includes {
+			if glob.matchPrefix(parts) {
+				matched[idx] = true
+				matches = append(matches, indexes[idx])
+			}
+		}
+		if len(matches) == 0 {
+			return nil
+		}
+		return fn(filepath.ToSlash(rel), matches)
 	})
-	return allList, nil
+	if err != nil {
+		return logex.Trace(err)
+	}
+	for idx, glob := range includes {
+		if !matched[idx] {
+			return logex.NewErrorf("pattern %q matches no file", glob.pattern)
+		}
+	}
+	return nil
+}
+
+type globPattern struct {
+	pattern string
+	parts   []string
+}
+
+// parsePattern splits a pattern into its segments, "." is the root.
+func parsePattern(pattern string) (*globPattern, bool, error) {
+	glob := &globPattern{pattern: pattern}
+	exclude := strings.HasPrefix(pattern, "!")
+	if exclude {
+		pattern = pattern[1:]
+	}
+	clean := path.Clean(pattern)
+	if pattern == "" || path.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, "../") {
+		return nil, exclude, logex.NewErrorf("invalid pattern: %q", glob.pattern)
+	}
+	if clean == "." {
+		return glob, exclude, nil
+	}
+	glob.parts = strings.Split(clean, "/")
+	for _, part := range glob.parts {
+		if _, err := path.Match(part, ""); err != nil {
+			return nil, exclude, logex.NewErrorf("invalid pattern %q: %v", glob.pattern, err)
+		}
+	}
+	return glob, exclude, nil
+}
+
+// matchPrefix reports whether the pattern matches the path or one of its
+// parent directories.
+func (g *globPattern) matchPrefix(parts []string) bool {
+	for idx := len(parts); idx >= 0; idx-- {
+		if matchParts(g.parts, parts[:idx]) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchDir reports whether the pattern may match a file under the
+// directory.
+func (g *globPattern) matchDir(parts []string) bool {
+	pattern := g.parts
+	for len(pattern) > 0 && len(parts) > 0 {
+		if pattern[0] == "**" {
+			return true
+		}
+		if ok, _ := path.Match(pattern[0], parts[0]); !ok {
+			return false
+		}
+		pattern, parts = pattern[1:], parts[1:]
+	}
+	// either a parent of what the pattern matches or under a matched path
+	return true
+}
+
+func matchParts(pattern, parts []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(parts); i++ {
+				if matchParts(pattern[1:], parts[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(parts) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], parts[0]); !ok {
+			return false
+		}
+		pattern, parts = pattern[1:], parts[1:]
+	}
+	return len(parts) == 0
 }
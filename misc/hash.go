@@ -1,100 +1,566 @@
 package misc
 
 import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"encoding/hex"
+	"hash"
 	"io"
 	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
 	"sync"
 
 	"github.com/chzyer/logex"
 	"github.com/wealdtech/go-merkletree"
-	"github.com/wealdtech/go-merkletree/keccak256"
 	"golang.org/x/crypto/sha3"
+	"golang.org/x/sync/errgroup"
 )
 
-func GetFileHash(fp string) ([]byte, error) {
+// HashAlgorithm hashes both the leaves and the nodes of a merkle tree.
+type HashAlgorithm string
+
+var (
+	HashKeccak256 HashAlgorithm = "keccak256"
+	HashSha256    HashAlgorithm = "sha256"
+	HashSha384    HashAlgorithm = "sha384"
+)
+
+var hashAlgorithms = map[HashAlgorithm]func() hash.Hash{
+	HashKeccak256: sha3.NewLegacyKeccak256,
+	HashSha256:    sha256.New,
+	HashSha384:    sha512.New384,
+}
+
+// ParseHashAlgorithms checks the algorithm names, the first one is the
+// algorithm of the attested input and output hash. It defaults to
+// keccak256.
+func ParseHashAlgorithms(names []string) ([]HashAlgorithm, error) {
+	if len(names) == 0 {
+		return []HashAlgorithm{HashKeccak256}, nil
+	}
+	algorithms := make([]HashAlgorithm, 0, len(names))
+	seen := make(map[HashAlgorithm]bool)
+	for _, name := range names {
+		algorithm := HashAlgorithm(strings.ToLower(strings.TrimSpace(name)))
+		if _, ok := hashAlgorithms[algorithm]; !ok {
+			return nil, logex.NewErrorf("unknown hash algorithm %q, expect keccak256, sha256 or sha384", name)
+		}
+		if seen[algorithm] {
+			return nil, logex.NewErrorf("duplicated hash algorithm %q", name)
+		}
+		seen[algorithm] = true
+		algorithms = append(algorithms, algorithm)
+	}
+	return algorithms, nil
+}
+
+func (a HashAlgorithm) New() hash.Hash {
+	return hashAlgorithms[a]()
+}
+
+// Hash implements merkletree.HashType.
+func (a HashAlgorithm) Hash(data []byte) []byte {
+	h := a.New()
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+// LeafVersion is the encoding of the merkle leaves, it's attested with the
+// roots. Version 1 hashed the path and the content only.
+const LeafVersion = 2
+
+const (
+	leafFile    = 'f'
+	leafSymlink = 'l'
+)
+
+// GetMappedFileHashes returns the leaves of file.Src published as file.Dst
+// for each algorithm, the file is read once. A leaf is the hash of the leaf
+// version, the file type, the unix mode(4 bytes), the name and the content,
+// or the target of a symlink, which is never followed. The name and the
+// content are prefixed by their length(8 bytes), all the integers are big
+// endian.
+func GetMappedFileHashes(root string, file *FileMapping, algorithms []HashAlgorithm) ([][]byte, error) {
+	hashes := newHashes(algorithms)
+	w := hashWriter(hashes)
+	sum := func() [][]byte {
+		return sumHashes(hashes)
+	}
+
+	fp := filepath.Join(root, file.Src)
+	fi, err := os.Lstat(fp)
+	if err != nil {
+		return nil, logex.Trace(err)
+	}
+	if fi.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(fp)
+		if err != nil {
+			return nil, logex.Trace(err)
+		}
+		writeLeafHeader(w, leafSymlink, 0, file.Dst, int64(len(target)))
+		w.Write([]byte(target))
+		return sum(), nil
+	}
+	if !fi.Mode().IsRegular() {
+		return nil, logex.NewErrorf("unsupported file type: %v(%v)", file.Src, fi.Mode().Type())
+	}
+
 	fd, err := os.Open(fp)
 	if err != nil {
 		return nil, logex.Trace(err)
 	}
 	defer fd.Close()
-
-	fi, err := fd.Stat()
+	fi, err = fd.Stat()
+	if err != nil {
+		return nil, logex.Trace(err)
+	}
+	if !fi.Mode().IsRegular() {
+		return nil, logex.NewErrorf("%v changed while hashing", file.Src)
+	}
+	writeLeafHeader(w, leafFile, unixMode(fi.Mode()), file.Dst, fi.Size())
+	n, err := io.Copy(w, fd)
 	if err != nil {
+		return nil, logex.Trace(err, file.Src)
+	}
+	if n != fi.Size() {
+		return nil, logex.NewErrorf("size mismatch: %v", file.Src)
+	}
+	return sum(), nil
+}
+
+func writeLeafHeader(w io.Writer, typ byte, mode uint32, name string, size int64) {
+	var buf [14]byte
+	buf[0] = LeafVersion
+	buf[1] = typ
+	binary.BigEndian.PutUint32(buf[2:], mode)
+	binary.BigEndian.PutUint64(buf[6:], uint64(len(name)))
+	w.Write(buf[:])
+	w.Write([]byte(name))
+	binary.BigEndian.PutUint64(buf[:8], uint64(size))
+	w.Write(buf[:8])
+}
+
+// unixMode returns the permission bits along with setuid, setgid and
+// sticky.
+func unixMode(mode os.FileMode) uint32 {
+	ret := uint32(mode.Perm())
+	if mode&os.ModeSetuid != 0 {
+		ret |= 04000
+	}
+	if mode&os.ModeSetgid != 0 {
+		ret |= 02000
+	}
+	if mode&os.ModeSticky != 0 {
+		ret |= 01000
+	}
+	return ret
+}
+
+// TarLeaves returns the leaves of the files in the tarball fp for each
+// algorithm, they are named by their path in the tarball, which is where
+// they are published. A hard link shares the content and the mode of its
+// target.
+func TarLeaves(fp string, algorithms []HashAlgorithm) (map[string][][]byte, error) {
+	// the links follow their targets, find them first to read every content once
+	links := make(map[string][]string)
+	if err := walkTar(fp, func(hdr *tar.Header, r io.Reader) error {
+		if hdr.Typeflag == tar.TypeLink {
+			target := path.Clean(hdr.Linkname)
+			links[target] = append(links[target], path.Clean(hdr.Name))
+		}
+		return nil
+	}); err != nil {
 		return nil, logex.Trace(err)
 	}
 
-	hash := sha3.NewLegacyKeccak256()
-	if _, err := hash.Write([]byte(fp)); err != nil {
+	leaves := make(map[string][][]byte)
+	err := walkTar(fp, func(hdr *tar.Header, r io.Reader) error {
+		name := path.Clean(hdr.Name)
+		switch hdr.Typeflag {
+		case tar.TypeDir, tar.TypeLink:
+			return nil
+		case tar.TypeSymlink:
+			hashes := newHashes(algorithms)
+			w := hashWriter(hashes)
+			writeLeafHeader(w, leafSymlink, 0, name, int64(len(hdr.Linkname)))
+			w.Write([]byte(hdr.Linkname))
+			leaves[name] = sumHashes(hashes)
+			return nil
+		case tar.TypeReg:
+		default:
+			return logex.NewErrorf("unsupported file type: %v(%c)", name, hdr.Typeflag)
+		}
+		names := append([]string{name}, links[name]...)
+		hashes := make([][]hash.Hash, len(names))
+		writers := make([]io.Writer, len(names))
+		for idx, name := range names {
+			hashes[idx] = newHashes(algorithms)
+			writers[idx] = hashWriter(hashes[idx])
+			writeLeafHeader(writers[idx], leafFile, unixMode(hdr.FileInfo().Mode()), name, hdr.Size)
+		}
+		if _, err := io.Copy(io.MultiWriter(writers...), r); err != nil {
+			return logex.Trace(err, name)
+		}
+		for idx, name := range names {
+			if _, ok := leaves[name]; ok {
+				return logex.NewErrorf("duplicated file in the tarball: %v", name)
+			}
+			leaves[name] = sumHashes(hashes[idx])
+		}
+		return nil
+	})
+	if err != nil {
 		return nil, logex.Trace(err)
 	}
+	return leaves, nil
+}
 
-	if !fi.IsDir() {
-		n, err := io.Copy(hash, fd)
+func walkTar(fp string, fn func(hdr *tar.Header, r io.Reader) error) error {
+	fd, err := os.Open(fp)
+	if err != nil {
+		return logex.Trace(err)
+	}
+	defer fd.Close()
+	r := tar.NewReader(fd)
+	for {
+		hdr, err := r.Next()
+		if err == io.EOF {
+			return nil
+		}
 		if err != nil {
-			return nil, logex.Trace(err, fp)
+			return logex.Trace(err)
 		}
-		if n != fi.Size() {
-			return nil, logex.NewErrorf("size mismatch")
+		if err := fn(hdr, r); err != nil {
+			return logex.Trace(err)
 		}
 	}
-	data := hash.Sum(nil)
-	return data, nil
 }
 
-type MerkleTreeResult struct {
-	Tree     *merkletree.MerkleTree
-	Root     []byte
-	FileList []string
+func newHashes(algorithms []HashAlgorithm) []hash.Hash {
+	hashes := make([]hash.Hash, len(algorithms))
+	for idx, algorithm := range algorithms {
+		hashes[idx] = algorithm.New()
+	}
+	return hashes
+}
+
+func hashWriter(hashes []hash.Hash) io.Writer {
+	writers := make([]io.Writer, len(hashes))
+	for idx, h := range hashes {
+		writers[idx] = h
+	}
+	return io.MultiWriter(writers...)
+}
+
+func sumHashes(hashes []hash.Hash) [][]byte {
+	sums := make([][]byte, len(hashes))
+	for idx, h := range hashes {
+		sums[idx] = h.Sum(nil)
+	}
+	return sums
 }
 
-func FilesMerkleTree(patterns []string, workers int, salt []byte) (*MerkleTreeResult, error) {
-	type Task struct {
-		FilePath string
-		Idx      int
+// GetContentHash returns the hex sha256 of the file content, it addresses
+// the file in a content-addressed store regardless of its path.
+func GetContentHash(root, fp string) (string, error) {
+	h := sha256.New()
+	if err := hashFile(h, root, fp); err != nil {
+		return "", logex.Trace(err)
 	}
-	fileList, err := GlobSortList(patterns)
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// hashFile writes the content of the file to w, or the target of a
+// symlink, which is never followed, as the leaves do.
+func hashFile(w io.Writer, root, fp string) error {
+	fi, err := os.Lstat(filepath.Join(root, fp))
 	if err != nil {
-		return nil, logex.Trace(err)
+		return logex.Trace(err)
+	}
+	if fi.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(filepath.Join(root, fp))
+		if err != nil {
+			return logex.Trace(err)
+		}
+		_, err = w.Write([]byte(target))
+		return logex.Trace(err)
+	}
+	if !fi.Mode().IsRegular() {
+		return logex.NewErrorf("unsupported file type: %v(%v)", fp, fi.Mode().Type())
+	}
+
+	fd, err := os.Open(filepath.Join(root, fp))
+	if err != nil {
+		return logex.Trace(err)
+	}
+	defer fd.Close()
+	after, err := fd.Stat()
+	if err != nil {
+		return logex.Trace(err)
+	}
+	if !os.SameFile(fi, after) {
+		return logex.NewErrorf("%v changed while hashing", fp)
 	}
-	output := make([][]byte, len(fileList))
-	ch := make(chan *Task, workers)
-	errs := make(chan error, 1)
-	var wg sync.WaitGroup
+	n, err := io.Copy(w, fd)
+	if err != nil {
+		return logex.Trace(err, fp)
+	}
+	if n != after.Size() {
+		return logex.NewErrorf("size mismatch: %v", fp)
+	}
+	return nil
+}
+
+// FileMapping publishes the file Src, relative to the tree root, as Dst.
+type FileMapping struct {
+	Src string
+	Dst string
+}
+
+// MerkleTreeResult lists the files by their published names, Sources holds
+// the path of each in the tree.
+type MerkleTreeResult struct {
+	Algorithm HashAlgorithm
+	Tree      *merkletree.MerkleTree
+	Root      []byte
+	FileList  []string
+	Sources   []string
+	Leaves    [][]byte
+
+	salt []byte
+}
+
+// Mapped reports whether some files are published under another name.
+func (r *MerkleTreeResult) Mapped() bool {
+	for idx, src := range r.Sources {
+		if src != r.FileList[idx] {
+			return true
+		}
+	}
+	return false
+}
+
+// FilesMerkleTrees builds a tree per algorithm over the files matched by
+// the patterns, they are hashed while the tree is walked. The leaves of the
+// unchanged files come from the cache if any.
+func FilesMerkleTrees(ctx context.Context, root string, patterns []string, algorithms []HashAlgorithm, workers int, cache *HashCache, salt []byte) ([]*MerkleTreeResult, error) {
+	return merkleTrees(ctx, root, algorithms, workers, cache, salt, func(emit func(*FileMapping) error) error {
+		return WalkGlob(root, patterns, func(fp string) error {
+			return emit(&FileMapping{Src: fp, Dst: fp})
+		})
+	})
+}
+
+// MappedMerkleTrees builds a tree per algorithm of the files sorted by
+// their published names, the leaves commit to those names.
+func MappedMerkleTrees(ctx context.Context, root string, files []*FileMapping, algorithms []HashAlgorithm, workers int, salt []byte) ([]*MerkleTreeResult, error) {
+	return merkleTrees(ctx, root, algorithms, workers, nil, salt, func(emit func(*FileMapping) error) error {
+		for _, file := range files {
+			if err := emit(file); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// merkleTrees hashes the files emitted by list with workers goroutines, or
+// one per cpu if workers isn't positive. The first failure cancels the
+// others.
+func merkleTrees(ctx context.Context, root string, algorithms []HashAlgorithm, workers int, cache *HashCache, salt []byte, list func(emit func(*FileMapping) error) error) ([]*MerkleTreeResult, error) {
+	type fileLeaves struct {
+		file   *FileMapping
+		leaves [][]byte
+	}
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	group, ctx := errgroup.WithContext(ctx)
+	ch := make(chan *FileMapping, workers)
+	group.Go(func() error {
+		defer close(ch)
+		return list(func(file *FileMapping) error {
+			select {
+			case ch <- file:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		})
+	})
+
+	var mu sync.Mutex
+	var hashed []*fileLeaves
 	for i := 0; i < workers; i++ {
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			var err error
-			for task := range ch {
-				output[task.Idx], err = GetFileHash(task.FilePath)
+		group.Go(func() error {
+			for file := range ch {
+				if err := ctx.Err(); err != nil {
+					return err
+				}
+				leaves, err := cache.MappedFileHashes(root, file, algorithms)
 				if err != nil {
-					errs <- logex.Trace(err)
-					break
+					return logex.Trace(err)
 				}
+				mu.Lock()
+				hashed = append(hashed, &fileLeaves{file: file, leaves: leaves})
+				mu.Unlock()
 			}
-		}()
+			return nil
+		})
+	}
+	if err := group.Wait(); err != nil {
+		return nil, logex.Trace(err)
 	}
-	go func() {
-		for idx, item := range fileList {
-			ch <- &Task{Idx: idx, FilePath: item}
+
+	sort.Slice(hashed, func(i, j int) bool {
+		return hashed[i].file.Dst < hashed[j].file.Dst
+	})
+	fileList := make([]string, len(hashed))
+	sources := make([]string, len(hashed))
+	for idx, item := range hashed {
+		if idx > 0 && item.file.Dst == fileList[idx-1] {
+			return nil, logex.NewErrorf("%v and %v are both published as %v", sources[idx-1], item.file.Src, item.file.Dst)
 		}
-		close(ch)
-	}()
-	wg.Wait()
+		fileList[idx] = item.file.Dst
+		sources[idx] = item.file.Src
+	}
 
-	select {
-	case err := <-errs:
-		return nil, logex.Trace(err)
-	default:
+	results := make([]*MerkleTreeResult, len(algorithms))
+	for i, algorithm := range algorithms {
+		leaves := make([][]byte, len(hashed))
+		for idx, item := range hashed {
+			leaves[idx] = item.leaves[i]
+		}
+		tree, err := merkletree.NewUsing(leaves, algorithm, salt)
+		if err != nil {
+			return nil, logex.Trace(err)
+		}
+		results[i] = &MerkleTreeResult{
+			Algorithm: algorithm,
+			Tree:      tree,
+			Root:      tree.Root(),
+			FileList:  fileList,
+			Sources:   sources,
+			Leaves:    leaves,
+			salt:      salt,
+		}
+	}
+	return results, nil
+}
+
+// RootHashes formats the root of each algorithm.
+func RootHashes(algorithms []HashAlgorithm, roots [][]byte) map[HashAlgorithm]string {
+	hashes := make(map[HashAlgorithm]string, len(algorithms))
+	for idx, algorithm := range algorithms {
+		hashes[algorithm] = "0x" + hex.EncodeToString(roots[idx])
 	}
+	return hashes
+}
 
-	tree, err := merkletree.NewUsing(output, keccak256.New(), salt)
+// CombineRoots returns the merkle root over several roots, it binds the
+// output sets of a matrix build to one hash.
+func CombineRoots(algorithm HashAlgorithm, roots [][]byte) ([]byte, error) {
+	tree, err := merkletree.NewUsing(roots, algorithm, nil)
 	if err != nil {
 		return nil, logex.Trace(err)
 	}
-	return &MerkleTreeResult{
-		Tree:     tree,
-		Root:     tree.Root(),
-		FileList: fileList,
-	}, nil
+	return tree.Root(), nil
+}
+
+type FileProof struct {
+	File   string   `json:"file"`
+	Leaf   string   `json:"leaf"`
+	Index  uint64   `json:"index"`
+	Hashes []string `json:"hashes"`
+}
+
+// MerkleProofs proves every file of the tree against Root, so a single
+// file can be checked without the others.
+type MerkleProofs struct {
+	Algorithm   HashAlgorithm `json:"algorithm"`
+	Root        string        `json:"root"`
+	LeafVersion int           `json:"leaf_version"`
+	Files       []*FileProof  `json:"files"`
+}
+
+// Proofs proves every leaf by its index, the nodes are rebuilt once in the
+// layout of merkletree.NewUsing.
+func (r *MerkleTreeResult) Proofs() (*MerkleProofs, error) {
+	proofs := &MerkleProofs{
+		Algorithm:   r.Algorithm,
+		Root:        "0x" + hex.EncodeToString(r.Root),
+		LeafVersion: LeafVersion,
+	}
+	width := 1
+	for width < len(r.Leaves) {
+		width *= 2
+	}
+	nodes := make([][]byte, 2*width)
+	for idx, leaf := range r.Leaves {
+		nodes[width+idx] = r.Algorithm.Hash(append(leaf[:len(leaf):len(leaf)], r.salt...))
+	}
+	for idx := width - 1; idx > 0; idx-- {
+		nodes[idx] = r.Algorithm.Hash(append(append([]byte{}, nodes[idx*2]...), nodes[idx*2+1]...))
+	}
+	if !bytes.Equal(nodes[1], r.Root) {
+		return nil, logex.NewErrorf("the %v tree doesn't match its root", r.Algorithm)
+	}
+
+	for idx, leaf := range r.Leaves {
+		item := &FileProof{
+			File:   r.FileList[idx],
+			Leaf:   "0x" + hex.EncodeToString(leaf),
+			Index:  uint64(idx),
+			Hashes: []string{},
+		}
+		for node := width + idx; node > 1; node /= 2 {
+			item.Hashes = append(item.Hashes, "0x"+hex.EncodeToString(nodes[node^1]))
+		}
+		proofs.Files = append(proofs.Files, item)
+	}
+	return proofs, nil
+}
+
+func (p *MerkleProofs) Verify() error {
+	if _, ok := hashAlgorithms[p.Algorithm]; !ok {
+		return logex.NewErrorf("unknown hash algorithm %q", p.Algorithm)
+	}
+	root, err := decodeHex(p.Root)
+	if err != nil {
+		return logex.Trace(err)
+	}
+	for _, item := range p.Files {
+		leaf, err := decodeHex(item.Leaf)
+		if err != nil {
+			return logex.Trace(err, item.File)
+		}
+		proof := &merkletree.Proof{Index: item.Index}
+		for _, hash := range item.Hashes {
+			data, err := decodeHex(hash)
+			if err != nil {
+				return logex.Trace(err, item.File)
+			}
+			proof.Hashes = append(proof.Hashes, data)
+		}
+		ok, err := merkletree.VerifyProofUsing(leaf, proof, root, p.Algorithm, nil)
+		if err != nil {
+			return logex.Trace(err, item.File)
+		}
+		if !ok {
+			return logex.NewErrorf("invalid proof for %v", item.File)
+		}
+	}
+	return nil
+}
+
+func decodeHex(s string) ([]byte, error) {
+	return hex.DecodeString(strings.TrimPrefix(s, "0x"))
 }
@@ -0,0 +1,74 @@
+package misc
+
+import (
+	"encoding/hex"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/wealdtech/go-merkletree"
+)
+
+// Proofs rebuilds the tree in the layout of go-merkletree, its proofs must
+// stay the ones of the library.
+func TestMerkleTreeResultProofs(t *testing.T) {
+	for algorithm := range hashAlgorithms {
+		for _, n := range []int{1, 2, 3, 5, 8} {
+			t.Run(fmt.Sprintf("%v/%v", algorithm, n), func(t *testing.T) {
+				leaves := make([][]byte, n)
+				files := make([]string, n)
+				for idx := range leaves {
+					files[idx] = fmt.Sprintf("file%v", idx)
+					leaves[idx] = algorithm.Hash([]byte(files[idx]))
+				}
+				tree, err := merkletree.NewUsing(leaves, algorithm, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				result := &MerkleTreeResult{
+					Algorithm: algorithm,
+					Tree:      tree,
+					Root:      tree.Root(),
+					FileList:  files,
+					Sources:   files,
+					Leaves:    leaves,
+				}
+				proofs, err := result.Proofs()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(proofs.Files) != n {
+					t.Fatalf("got %v proofs", len(proofs.Files))
+				}
+				for idx, file := range proofs.Files {
+					expect, err := tree.GenerateProof(leaves[idx])
+					if err != nil {
+						t.Fatal(err)
+					}
+					hashes := []string{}
+					for _, hash := range expect.Hashes {
+						hashes = append(hashes, "0x"+hex.EncodeToString(hash))
+					}
+					if file.File != files[idx] || file.Index != expect.Index || !reflect.DeepEqual(file.Hashes, hashes) {
+						t.Fatalf("proof of %v: got %v at %v, expect %v at %v", files[idx], file.Hashes, file.Index, hashes, expect.Index)
+					}
+					ok, err := merkletree.VerifyProofUsing(leaves[idx], expect, tree.Root(), algorithm, nil)
+					if err != nil || !ok {
+						t.Fatalf("library proof of %v: %v, %v", files[idx], ok, err)
+					}
+				}
+				if err := proofs.Verify(); err != nil {
+					t.Fatal(err)
+				}
+
+				// a proof of another leaf never verifies
+				if n > 1 {
+					proofs.Files[0].Leaf = proofs.Files[1].Leaf
+					if err := proofs.Verify(); err == nil {
+						t.Fatal("a swapped leaf verifies")
+					}
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,357 @@
+package misc
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/chzyer/logex"
+)
+
+const hashCacheVersion = 1
+
+// hashCacheRacy is how close to the hashing time a change must be to make
+// the entry untrustworthy, it covers coarse file system timestamps.
+const hashCacheRacy = 2 * time.Second
+
+type hashCacheKey struct {
+	Path string
+	Kind string
+}
+
+// HashCacheEntry is a hash of a file along with the identity of the file
+// when it was hashed.
+type HashCacheEntry struct {
+	Path     string `json:"path"`
+	Kind     string `json:"kind"`
+	Size     int64  `json:"size"`
+	Mtime    int64  `json:"mtime"`
+	Ctime    int64  `json:"ctime"`
+	Inode    uint64 `json:"inode"`
+	Hash     string `json:"hash"`
+	HashedAt int64  `json:"hashed_at"`
+	UsedAt   int64  `json:"used_at"`
+}
+
+// sameFile reports whether the file still looks the way it was hashed.
+func (e *HashCacheEntry) sameFile(fi os.FileInfo) bool {
+	size, mtime, ctime, inode := fileIdentity(fi)
+	return e.Size == size && e.Mtime == mtime && e.Ctime == ctime && e.Inode == inode
+}
+
+type hashCacheFile struct {
+	Version int               `json:"version"`
+	Entries []*HashCacheEntry `json:"entries"`
+}
+
+// HashCache remembers the hashes of the files on the host, so an unchanged
+// file isn't read again. An entry is only used while the size, mtime, ctime
+// and inode of the file are unchanged, and a file changed right before it
+// was hashed is never cached since a later change may keep its timestamps.
+// The cache is shared between processes through a locked json file. A nil
+// *HashCache hashes every time.
+type HashCache struct {
+	File string
+
+	mu      sync.Mutex
+	entries map[hashCacheKey]*HashCacheEntry
+	changed map[hashCacheKey]bool
+}
+
+func DefaultHashCacheFile() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		home = os.TempDir()
+	}
+	return filepath.Join(home, ".tee-compile", "hashcache.json")
+}
+
+func OpenHashCache(fp string) (*HashCache, error) {
+	if fp == "" {
+		fp = DefaultHashCacheFile()
+	}
+	c := &HashCache{
+		File:    fp,
+		entries: make(map[hashCacheKey]*HashCacheEntry),
+		changed: make(map[hashCacheKey]bool),
+	}
+	if err := c.locked(func(entries []*HashCacheEntry) ([]*HashCacheEntry, error) {
+		for _, entry := range entries {
+			c.entries[hashCacheKey{entry.Path, entry.Kind}] = entry
+		}
+		return nil, nil
+	}); err != nil {
+		return nil, logex.Trace(err)
+	}
+	return c, nil
+}
+
+// locked runs fn with the entries of the file under its lock, the file is
+// rewritten if fn returns some entries.
+func (c *HashCache) locked(fn func(entries []*HashCacheEntry) ([]*HashCacheEntry, error)) error {
+	if err := os.MkdirAll(filepath.Dir(c.File), 0755); err != nil {
+		return logex.Trace(err)
+	}
+	unlock, err := Flock(c.File + ".lock")
+	if err != nil {
+		return logex.Trace(err)
+	}
+	defer unlock()
+
+	var state hashCacheFile
+	data, err := os.ReadFile(c.File)
+	if err != nil && !os.IsNotExist(err) {
+		return logex.Trace(err)
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &state); err != nil || state.Version != hashCacheVersion {
+			// it's only a cache, start over
+			logex.Warn(fmt.Sprintf("drop the hash cache %v: unknown format", c.File))
+			state = hashCacheFile{}
+		}
+	}
+
+	entries, err := fn(state.Entries)
+	if err != nil || entries == nil {
+		return logex.Trace(err)
+	}
+	data, err = json.Marshal(&hashCacheFile{Version: hashCacheVersion, Entries: entries})
+	if err != nil {
+		return logex.Trace(err)
+	}
+	tmp := c.File + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return logex.Trace(err)
+	}
+	if err := os.Rename(tmp, c.File); err != nil {
+		return logex.Trace(err)
+	}
+	return nil
+}
+
+// Save merges the entries hashed or used since the cache was opened into
+// the file.
+func (c *HashCache) Save() error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.changed) == 0 {
+		return nil
+	}
+	err := c.locked(func(entries []*HashCacheEntry) ([]*HashCacheEntry, error) {
+		merged := make(map[hashCacheKey]*HashCacheEntry, len(entries))
+		ret := make([]*HashCacheEntry, 0, len(entries)+len(c.changed))
+		for _, entry := range entries {
+			key := hashCacheKey{entry.Path, entry.Kind}
+			if mine := c.entries[key]; c.changed[key] && mine != nil && mine.UsedAt >= entry.UsedAt {
+				entry = mine
+			}
+			merged[key] = entry
+			ret = append(ret, entry)
+		}
+		for key := range c.changed {
+			if _, ok := merged[key]; !ok {
+				ret = append(ret, c.entries[key])
+			}
+		}
+		return ret, nil
+	})
+	if err != nil {
+		return logex.Trace(err)
+	}
+	c.changed = make(map[hashCacheKey]bool)
+	return nil
+}
+
+// Hash returns the hash of kind of the file fp, compute is only called if
+// the cache has no valid entry.
+func (c *HashCache) Hash(fp, kind string, compute func() (string, error)) (string, error) {
+	if c == nil {
+		return compute()
+	}
+	hashes, err := c.hashes(fp, []string{kind}, func() ([]string, error) {
+		hash, err := compute()
+		return []string{hash}, err
+	})
+	if err != nil {
+		return "", logex.Trace(err)
+	}
+	return hashes[0], nil
+}
+
+// MappedFileHashes is GetMappedFileHashes through the cache. The leaves of
+// all the algorithms come from the same version of the file, either they
+// are all cached or the file is read once for all of them.
+func (c *HashCache) MappedFileHashes(root string, file *FileMapping, algorithms []HashAlgorithm) ([][]byte, error) {
+	if c == nil {
+		return GetMappedFileHashes(root, file, algorithms)
+	}
+	kinds := make([]string, len(algorithms))
+	for idx, algorithm := range algorithms {
+		kinds[idx] = fmt.Sprintf("leaf%v-%v:%v", LeafVersion, algorithm, file.Dst)
+	}
+	hashes, err := c.hashes(filepath.Join(root, file.Src), kinds, func() ([]string, error) {
+		leaves, err := GetMappedFileHashes(root, file, algorithms)
+		if err != nil {
+			return nil, logex.Trace(err)
+		}
+		hashes := make([]string, len(leaves))
+		for idx, leaf := range leaves {
+			hashes[idx] = hex.EncodeToString(leaf)
+		}
+		return hashes, nil
+	})
+	if err != nil {
+		return nil, logex.Trace(err)
+	}
+	ret := make([][]byte, len(hashes))
+	for idx, hash := range hashes {
+		ret[idx], err = hex.DecodeString(hash)
+		if err != nil {
+			return nil, logex.Trace(err)
+		}
+	}
+	return ret, nil
+}
+
+// hashes returns the hashes of the kinds of the file fp, the file is
+// stat'ed once. They come from the cache only if every kind has a valid
+// entry, otherwise compute returns all of them and they are cached if the
+// file stayed the same.
+func (c *HashCache) hashes(fp string, kinds []string, compute func() ([]string, error)) ([]string, error) {
+	fp, err := filepath.Abs(fp)
+	if err != nil {
+		return nil, logex.Trace(err)
+	}
+	fi, err := os.Lstat(fp)
+	if err != nil {
+		return nil, logex.Trace(err)
+	}
+	now := time.Now()
+
+	c.mu.Lock()
+	hashes := make([]string, len(kinds))
+	hit := true
+	for idx, kind := range kinds {
+		entry := c.entries[hashCacheKey{fp, kind}]
+		if entry == nil || !entry.sameFile(fi) {
+			hit = false
+			break
+		}
+		hashes[idx] = entry.Hash
+	}
+	if hit {
+		for _, kind := range kinds {
+			key := hashCacheKey{fp, kind}
+			c.entries[key].UsedAt = now.Unix()
+			c.changed[key] = true
+		}
+		c.mu.Unlock()
+		return hashes, nil
+	}
+	c.mu.Unlock()
+
+	hashes, err = compute()
+	if err != nil {
+		return nil, logex.Trace(err)
+	}
+	if len(hashes) != len(kinds) {
+		return nil, logex.NewErrorf("got %v hashes of %v, expect %v", len(hashes), fp, len(kinds))
+	}
+	after, err := os.Lstat(fp)
+	if err != nil {
+		return nil, logex.Trace(err)
+	}
+	size, mtime, ctime, inode := fileIdentity(fi)
+	stat := &HashCacheEntry{Size: size, Mtime: mtime, Ctime: ctime, Inode: inode}
+	// a change in the same timestamp tick as the hashing would go unnoticed
+	if !stat.sameFile(after) || now.UnixNano()-mtime < int64(hashCacheRacy) ||
+		now.UnixNano()-ctime < int64(hashCacheRacy) {
+		return hashes, nil
+	}
+
+	c.mu.Lock()
+	for idx, kind := range kinds {
+		key := hashCacheKey{fp, kind}
+		entry := *stat
+		entry.Path = fp
+		entry.Kind = kind
+		entry.Hash = hashes[idx]
+		entry.HashedAt = now.Unix()
+		entry.UsedAt = now.Unix()
+		c.entries[key] = &entry
+		c.changed[key] = true
+	}
+	c.mu.Unlock()
+	return hashes, nil
+}
+
+// Prune drops the entries of the files which are gone or changed, and the
+// ones unused for maxAge if it's positive. It returns the number of the
+// entries kept and dropped.
+func (c *HashCache) Prune(maxAge time.Duration) (kept int, dropped int, err error) {
+	now := time.Now()
+	err = c.locked(func(entries []*HashCacheEntry) ([]*HashCacheEntry, error) {
+		ret := make([]*HashCacheEntry, 0, len(entries))
+		for _, entry := range entries {
+			if maxAge > 0 && now.Sub(time.Unix(entry.UsedAt, 0)) > maxAge {
+				continue
+			}
+			fi, err := os.Lstat(entry.Path)
+			if err != nil || !entry.sameFile(fi) {
+				continue
+			}
+			ret = append(ret, entry)
+		}
+		kept, dropped = len(ret), len(entries)-len(ret)
+		return ret, nil
+	})
+	if err != nil {
+		return 0, 0, logex.Trace(err)
+	}
+	c.mu.Lock()
+	c.entries = make(map[hashCacheKey]*HashCacheEntry)
+	c.changed = make(map[hashCacheKey]bool)
+	c.mu.Unlock()
+	return kept, dropped, nil
+}
+
+// Clear drops all the entries and returns their number.
+func (c *HashCache) Clear() (int, error) {
+	var dropped int
+	err := c.locked(func(entries []*HashCacheEntry) ([]*HashCacheEntry, error) {
+		dropped = len(entries)
+		return []*HashCacheEntry{}, nil
+	})
+	if err != nil {
+		return 0, logex.Trace(err)
+	}
+	c.mu.Lock()
+	c.entries = make(map[hashCacheKey]*HashCacheEntry)
+	c.changed = make(map[hashCacheKey]bool)
+	c.mu.Unlock()
+	return dropped, nil
+}
+
+// fileIdentity returns the size, mtime, ctime(ns) and inode of the file.
+func fileIdentity(fi os.FileInfo) (int64, int64, int64, uint64) {
+	var ctime int64
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		ctime = st.Ctim.Nano()
+	}
+	return fi.Size(), fi.ModTime().UnixNano(), ctime, fileInode(fi)
+}
+
+func fileInode(fi os.FileInfo) uint64 {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return st.Ino
+	}
+	return 0
+}
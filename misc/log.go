@@ -0,0 +1,87 @@
+package misc
+
+import (
+	"bytes"
+	"io"
+	"sync"
+
+	"github.com/chzyer/logex"
+)
+
+// PrefixWriter prepends a prefix to every line written, it's used to tell
+// apart the output of concurrent builds sharing the same log.
+type PrefixWriter struct {
+	w         io.Writer
+	prefix    []byte
+	mu        sync.Mutex
+	lineStart bool
+}
+
+func NewPrefixWriter(w io.Writer, prefix string) *PrefixWriter {
+	return &PrefixWriter{w: w, prefix: []byte(prefix), lineStart: true}
+}
+
+func (w *PrefixWriter) Write(data []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	n := len(data)
+	buf := bytes.NewBuffer(make([]byte, 0, len(data)+len(w.prefix)))
+	for len(data) > 0 {
+		if w.lineStart {
+			buf.Write(w.prefix)
+			w.lineStart = false
+		}
+		idx := bytes.IndexByte(data, '\n')
+		if idx < 0 {
+			buf.Write(data)
+			break
+		}
+		buf.Write(data[:idx+1])
+		data = data[idx+1:]
+		w.lineStart = true
+	}
+	if _, err := w.w.Write(buf.Bytes()); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+func (o *LogOutput) WithPrefix(prefix string) *LogOutput {
+	o = o.withDefault()
+	return &LogOutput{
+		Stdout: NewPrefixWriter(o.Stdout, prefix),
+		Stderr: NewPrefixWriter(o.Stderr, prefix),
+	}
+}
+
+func (o *LogOutput) Logger() *logex.Logger {
+	return logex.NewLoggerEx(o.withDefault().Stdout)
+}
+
+// TailBuffer keeps the last Size bytes written to it.
+type TailBuffer struct {
+	Size int
+	mu   sync.Mutex
+	buf  []byte
+}
+
+func NewTailBuffer(size int) *TailBuffer {
+	return &TailBuffer{Size: size}
+}
+
+func (t *TailBuffer) Write(data []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.buf = append(t.buf, data...)
+	if len(t.buf) > t.Size {
+		t.buf = append([]byte(nil), t.buf[len(t.buf)-t.Size:]...)
+	}
+	return len(data), nil
+}
+
+func (t *TailBuffer) Bytes() []byte {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]byte(nil), t.buf...)
+}
@@ -0,0 +1,115 @@
+package misc
+
+import (
+	"io"
+	"os"
+	"regexp"
+	"sync"
+
+	"github.com/chzyer/logex"
+)
+
+var (
+	LogLevelDebug = "debug"
+	LogLevelInfo  = "info"
+	LogLevelWarn  = "warn"
+	LogLevelError = "error"
+)
+
+var logexLevel = regexp.MustCompile(`\]\[([A-Z]+)\] `)
+
+// levelOf extracts the level of a line written by logex.
+func levelOf(data []byte) string {
+	match := logexLevel.FindSubmatch(data)
+	if match == nil {
+		return LogLevelInfo
+	}
+	switch string(match[1]) {
+	case "DEBUG":
+		return LogLevelDebug
+	case "WARN":
+		return LogLevelWarn
+	case "ERROR", "FATAL", "PANIC":
+		return LogLevelError
+	default:
+		return LogLevelInfo
+	}
+}
+
+// LogRouter sends the logs of each source to the host through the current
+// LogStream. The console gets a copy in debug mode, or when there is no
+// host to send to.
+type LogRouter struct {
+	Debug   bool
+	Console *LogOutput
+
+	mu     sync.RWMutex
+	stream *LogStream
+}
+
+func NewLogRouter(debug bool) *LogRouter {
+	return &LogRouter{
+		Debug:   debug,
+		Console: &LogOutput{Stdout: os.Stdout, Stderr: os.Stderr},
+	}
+}
+
+// SetStream switches to the new stream and returns the previous one.
+func (r *LogRouter) SetStream(stream *LogStream) *LogStream {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	old := r.stream
+	r.stream = stream
+	return old
+}
+
+// Output is for the commands, stdout and stderr are kept apart.
+func (r *LogRouter) Output(source string) *LogOutput {
+	return &LogOutput{
+		Stdout: &routeWriter{router: r, source: source, stream: "stdout", level: LogLevelInfo},
+		Stderr: &routeWriter{router: r, source: source, stream: "stderr", level: LogLevelInfo},
+	}
+}
+
+// Logger is for the log lines, their level is taken from the logex prefix.
+func (r *LogRouter) Logger(source string) *logex.Logger {
+	return logex.NewLoggerEx(&routeWriter{router: r, source: source, stream: "stdout"})
+}
+
+type routeWriter struct {
+	router *LogRouter
+	source string
+	stream string
+	level  string
+}
+
+func (w *routeWriter) Write(data []byte) (int, error) {
+	level := w.level
+	if level == "" {
+		level = levelOf(data)
+	}
+
+	w.router.mu.RLock()
+	stream := w.router.stream
+	w.router.mu.RUnlock()
+
+	if stream != nil {
+		err := stream.Send(&LogFrame{
+			Stream: w.stream,
+			Level:  level,
+			Source: w.source,
+			Data:   string(data),
+		})
+		if err != nil {
+			stream = nil
+		}
+	}
+	if stream == nil || w.router.Debug {
+		var console io.Writer = w.router.Console.Stdout
+		if w.stream == "stderr" || level == LogLevelError {
+			console = w.router.Console.Stderr
+		}
+		console.Write(data)
+	}
+	return len(data), nil
+}
@@ -0,0 +1,244 @@
+package misc
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chzyer/logex"
+)
+
+type LogFrame struct {
+	Seq    uint64    `json:"seq"`
+	Time   time.Time `json:"time"`
+	Stream string    `json:"stream"`
+	Level  string    `json:"level,omitempty"`
+	Source string    `json:"source,omitempty"`
+	Data   string    `json:"data"`
+}
+
+// LogStream sends the logs to the host as newline-delimited LogFrames over
+// a single long-lived chunked POST. The writers block once Buffer frames
+// are pending. After a reconnect the recent frames are sent again, the host
+// drops the ones it has seen by their sequence number. The stream runs
+// over tls if config isn't nil.
+type LogStream struct {
+	url    string
+	client *http.Client
+
+	mu     sync.Mutex
+	seq    uint64
+	closed bool
+	frames chan *LogFrame
+	replay []*LogFrame
+	done   chan struct{}
+}
+
+const (
+	logStreamReplay  = 1024
+	logStreamRetries = 10
+)
+
+func NewLogStream(uri *url.URL, path string, buffer int, config *tls.Config) *LogStream {
+	s := &LogStream{
+		url:    URLBase(uri) + path,
+		client: NewClient(uri),
+		frames: make(chan *LogFrame, buffer),
+		done:   make(chan struct{}),
+	}
+	if config != nil {
+		s.url = TLSURLBase(uri) + path
+		s.client = NewTLSClient(uri, config)
+	}
+	go s.loop()
+	return s
+}
+
+// Send queues the frame, its Seq and Time are filled by the stream.
+func (s *LogStream) Send(frame *LogFrame) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return logex.NewErrorf("log stream closed")
+	}
+	s.seq++
+	frame.Seq = s.seq
+	frame.Time = time.Now().UTC()
+	// holding the lock keeps the frames in sequence order
+	s.frames <- frame
+	return nil
+}
+
+// Close flushes the pending frames and ends the stream.
+func (s *LogStream) Close() error {
+	s.mu.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.frames)
+	}
+	s.mu.Unlock()
+	<-s.done
+	return nil
+}
+
+func (s *LogStream) loop() {
+	defer close(s.done)
+	for retry := 0; ; retry++ {
+		err := s.stream(s.replay)
+		if err == nil {
+			return
+		}
+		if retry >= logStreamRetries {
+			logex.Error("log stream is broken, fallback to stderr:", err)
+			break
+		}
+		logex.Error("log stream is broken, reconnecting:", err)
+		time.Sleep(time.Second)
+	}
+	for frame := range s.frames {
+		os.Stderr.WriteString(frame.Data)
+	}
+}
+
+func (s *LogStream) remember(frame *LogFrame) {
+	s.replay = append(s.replay, frame)
+	if len(s.replay) > logStreamReplay {
+		s.replay = s.replay[len(s.replay)-logStreamReplay:]
+	}
+}
+
+func (s *LogStream) stream(pending []*LogFrame) error {
+	pr, pw := io.Pipe()
+	result := make(chan error, 1)
+	go func() {
+		response, err := s.client.Post(s.url, "application/x-ndjson", pr)
+		if err == nil {
+			response.Body.Close()
+			if response.StatusCode != 200 {
+				err = logex.NewErrorf("unexpected status: %v", response.Status)
+			}
+		}
+		if err != nil {
+			pr.CloseWithError(err)
+		}
+		result <- err
+	}()
+
+	buf := bufio.NewWriter(pw)
+	enc := json.NewEncoder(buf)
+	for _, frame := range pending {
+		if err := enc.Encode(frame); err != nil {
+			return logex.Trace(err)
+		}
+	}
+	if err := buf.Flush(); err != nil {
+		return logex.Trace(err)
+	}
+	for frame := range s.frames {
+		s.remember(frame)
+		if err := enc.Encode(frame); err != nil {
+			return logex.Trace(err)
+		}
+		if len(s.frames) == 0 {
+			if err := buf.Flush(); err != nil {
+				return logex.Trace(err)
+			}
+		}
+	}
+	if err := buf.Flush(); err != nil {
+		return logex.Trace(err)
+	}
+	pw.Close()
+	if err := <-result; err != nil {
+		return logex.Trace(err)
+	}
+	return nil
+}
+
+// LogReceiver is the host side of LogStream, it writes the frames to the
+// console and keeps a timestamped copy in File.
+type LogReceiver struct {
+	Console *LogOutput
+	File    io.Writer
+	Debug   bool
+
+	mu        sync.Mutex
+	seq       uint64
+	lineStart map[string]bool
+}
+
+func NewLogReceiver(console *LogOutput, file io.Writer) *LogReceiver {
+	return &LogReceiver{
+		Console:   console.withDefault(),
+		File:      file,
+		lineStart: make(map[string]bool),
+	}
+}
+
+func (r *LogReceiver) Receive(body io.Reader) error {
+	dec := json.NewDecoder(body)
+	for {
+		var frame LogFrame
+		if err := dec.Decode(&frame); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return logex.Trace(err)
+		}
+		r.write(&frame)
+	}
+}
+
+func (r *LogReceiver) write(frame *LogFrame) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if frame.Seq <= r.seq {
+		return
+	}
+	r.seq = frame.Seq
+
+	if frame.Level != LogLevelDebug || r.Debug {
+		console := r.Console.Stdout
+		if frame.Stream == "stderr" {
+			console = r.Console.Stderr
+		}
+		console.Write([]byte(frame.Data))
+	}
+
+	if r.File == nil {
+		return
+	}
+	key := frame.Source + "/" + frame.Stream
+	lineStart, ok := r.lineStart[key]
+	if !ok {
+		lineStart = true
+	}
+	prefix := strings.Join([]string{
+		frame.Time.Format(time.RFC3339Nano), frame.Stream, frame.Level, frame.Source,
+	}, " ") + " | "
+	data := frame.Data
+	buf := make([]byte, 0, len(data)+len(prefix))
+	for len(data) > 0 {
+		if lineStart {
+			buf = append(buf, prefix...)
+			lineStart = false
+		}
+		idx := strings.IndexByte(data, '\n')
+		if idx < 0 {
+			buf = append(buf, data...)
+			break
+		}
+		buf = append(buf, data[:idx+1]...)
+		data = data[idx+1:]
+		lineStart = true
+	}
+	r.lineStart[key] = lineStart
+	r.File.Write(buf)
+}
@@ -1,18 +1,31 @@
 package misc
 
 import (
+	"context"
+	"crypto/tls"
 	"net"
+	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/chzyer/logex"
 	"github.com/mdlayher/vsock"
 )
 
+func unixPath(uri *url.URL) string {
+	return uri.Host + uri.Path
+}
+
 func Listen(uri *url.URL) (net.Listener, error) {
 	switch uri.Scheme {
 	case "unix", "tcp":
-		ln, err := net.Listen(uri.Scheme, uri.Host)
+		addr := uri.Host
+		if uri.Scheme == "unix" {
+			addr = unixPath(uri)
+		}
+		ln, err := net.Listen(uri.Scheme, addr)
 		if err != nil {
 			return nil, logex.Trace(err)
 		}
@@ -27,3 +40,114 @@ func Listen(uri *url.URL) (net.Listener, error) {
 		return nil, logex.NewErrorf("unsupport uri: %v", uri)
 	}
 }
+
+// ListenerURI returns the uri a peer uses to reach the listener, the
+// unspecified port or vsock cid is replaced with the actual one.
+func ListenerURI(uri *url.URL, ln net.Listener) (*url.URL, error) {
+	ret := *uri
+	switch uri.Scheme {
+	case "tcp":
+		ret.Host = ln.Addr().String()
+	case "vsock":
+		cid, err := vsock.ContextID()
+		if err != nil {
+			return nil, logex.Trace(err)
+		}
+		port := uri.Port()
+		if addr, ok := ln.Addr().(*vsock.Addr); ok {
+			port = strconv.Itoa(int(addr.Port))
+		}
+		ret.Host = net.JoinHostPort(strconv.Itoa(int(cid)), port)
+	}
+	return &ret, nil
+}
+
+// ParseURI parses the address of a listener, the legacy "cid:port" form is
+// treated as vsock.
+func ParseURI(addr string) (*url.URL, error) {
+	if !strings.Contains(addr, "://") {
+		addr = "vsock://" + addr
+	}
+	uri, err := url.Parse(addr)
+	if err != nil {
+		return nil, logex.Trace(err)
+	}
+	return uri, nil
+}
+
+func Dial(ctx context.Context, uri *url.URL) (net.Conn, error) {
+	switch uri.Scheme {
+	case "tcp":
+		var dialer net.Dialer
+		conn, err := dialer.DialContext(ctx, "tcp", uri.Host)
+		if err != nil {
+			return nil, logex.Trace(err)
+		}
+		return conn, nil
+	case "unix":
+		var dialer net.Dialer
+		conn, err := dialer.DialContext(ctx, "unix", unixPath(uri))
+		if err != nil {
+			return nil, logex.Trace(err)
+		}
+		return conn, nil
+	case "vsock":
+		contextId, err := strconv.Atoi(uri.Hostname())
+		if err != nil {
+			return nil, logex.Trace(err)
+		}
+		port, err := strconv.Atoi(uri.Port())
+		if err != nil {
+			return nil, logex.Trace(err)
+		}
+		conn, err := vsock.Dial(uint32(contextId), uint32(port), nil)
+		if err != nil {
+			return nil, logex.Trace(err)
+		}
+		return conn, nil
+	default:
+		return nil, logex.NewErrorf("unsupport uri: %v", uri)
+	}
+}
+
+// NewClient returns a http client which always connects to uri, the
+// requests should be sent to URLBase(uri).
+func NewClient(uri *url.URL) *http.Client {
+	return NewTLSClient(uri, nil)
+}
+
+// NewTLSClient is NewClient over tls, the requests should be sent to
+// TLSURLBase(uri).
+func NewTLSClient(uri *url.URL, config *tls.Config) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return Dial(ctx, uri)
+			},
+			TLSClientConfig:       config,
+			MaxIdleConns:          100,
+			IdleConnTimeout:       90 * time.Second,
+			ExpectContinueTimeout: 1 * time.Second,
+		},
+	}
+}
+
+func URLBase(uri *url.URL) string {
+	if uri.Scheme == "unix" {
+		return "http://localhost"
+	}
+	return "http://" + uri.Host
+}
+
+func TLSURLBase(uri *url.URL) string {
+	return "https://" + strings.TrimPrefix(URLBase(uri), "http://")
+}
+
+func FreePort() (int, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, logex.Trace(err)
+	}
+	defer ln.Close()
+	return ln.Addr().(*net.TCPAddr).Port, nil
+}
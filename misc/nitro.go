@@ -0,0 +1,207 @@
+package misc
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/chzyer/logex"
+)
+
+type NitroEnclave struct {
+	EnclaveName  string `json:"EnclaveName"`
+	EnclaveID    string `json:"EnclaveID"`
+	ProcessID    int    `json:"ProcessID"`
+	EnclaveCID   uint32 `json:"EnclaveCID"`
+	NumberOfCPUs int    `json:"NumberOfCPUs"`
+	MemoryMiB    int    `json:"MemoryMiB"`
+	State        string `json:"State"`
+}
+
+type NitroEnclaveOption struct {
+	Name  string
+	Path  string
+	Cpus  int
+	Mem   int
+	CID   uint32
+	Debug bool
+}
+
+func nitroCli(result interface{}, args ...string) error {
+	stdout := bytes.NewBuffer(nil)
+	cmd := exec.Command("nitro-cli", args...)
+	cmd.Stdout = stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return logex.Trace(err, fmt.Sprintf("nitro-cli %v", args[0]))
+	}
+	if result == nil {
+		return nil
+	}
+	// nitro-cli may print progress messages before the json result
+	data := stdout.Bytes()
+	idx := bytes.IndexAny(data, "{[")
+	if idx < 0 {
+		return logex.NewErrorf("unexpected nitro-cli output: %s", data)
+	}
+	if err := json.Unmarshal(data[idx:], result); err != nil {
+		return logex.Trace(err, string(data))
+	}
+	return nil
+}
+
+func RunNitroEnclave(opt *NitroEnclaveOption) (*NitroEnclave, error) {
+	args := []string{
+		"run-enclave",
+		"--cpu-count", fmt.Sprint(opt.Cpus),
+		"--memory", fmt.Sprint(opt.Mem),
+		"--enclave-cid", fmt.Sprint(opt.CID),
+		"--eif-path", opt.Path,
+	}
+	if opt.Name != "" {
+		args = append(args, "--enclave-name", opt.Name)
+	}
+	if opt.Debug {
+		args = append(args, "--debug-mode")
+	}
+	var enclave NitroEnclave
+	if err := nitroCli(&enclave, args...); err != nil {
+		return nil, logex.Trace(err)
+	}
+	return &enclave, nil
+}
+
+func DescribeNitroEnclaves() ([]*NitroEnclave, error) {
+	var enclaves []*NitroEnclave
+	if err := nitroCli(&enclaves, "describe-enclaves"); err != nil {
+		return nil, logex.Trace(err)
+	}
+	return enclaves, nil
+}
+
+type NitroMeasurements struct {
+	HashAlgorithm string `json:"HashAlgorithm"`
+	PCR0          string `json:"PCR0"`
+	PCR1          string `json:"PCR1"`
+	PCR2          string `json:"PCR2"`
+}
+
+// DescribeEif returns the PCRs an enclave booted from the image reports.
+func DescribeEif(path string) (*NitroMeasurements, error) {
+	var result struct {
+		Measurements *NitroMeasurements `json:"Measurements"`
+	}
+	if err := nitroCli(&result, "describe-eif", "--eif-path", path); err != nil {
+		return nil, logex.Trace(err)
+	}
+	if result.Measurements == nil {
+		return nil, logex.NewErrorf("no measurements of %v", path)
+	}
+	return result.Measurements, nil
+}
+
+func TerminateNitroEnclave(id string) error {
+	if err := nitroCli(nil, "terminate-enclave", "--enclave-id", id); err != nil {
+		return logex.Trace(err)
+	}
+	return nil
+}
+
+// NitroEnclaveConsole attaches to the console of a debug-mode enclave.
+func NitroEnclaveConsole(id string) *exec.Cmd {
+	cmd := exec.Command("nitro-cli", "console", "--enclave-id", id)
+	cmd.Stderr = os.Stderr
+	cmd.Stdout = os.Stdout
+	return cmd
+}
+
+const NitroAllocatorConfig = "/etc/nitro_enclaves/allocator.yaml"
+
+// the size of an enclave unless the manifest or the flags say otherwise
+const (
+	NitroDefaultCpus   = 2
+	NitroDefaultMemory = 12288
+)
+
+// NitroAllocator is the resources reserved for the enclaves by the
+// nitro-enclaves-allocator service.
+type NitroAllocator struct {
+	MemoryMiB int
+	CpuCount  int
+}
+
+func ReadNitroAllocator(fp string) (*NitroAllocator, error) {
+	data, err := os.ReadFile(fp)
+	if err != nil {
+		return nil, logex.Trace(err)
+	}
+	var alloc NitroAllocator
+	for _, line := range strings.Split(string(data), "\n") {
+		if idx := strings.Index(line, "#"); idx >= 0 {
+			line = line[:idx]
+		}
+		sp := strings.SplitN(line, ":", 2)
+		if len(sp) != 2 {
+			continue
+		}
+		key := strings.TrimSpace(sp[0])
+		value := strings.Trim(strings.TrimSpace(sp[1]), `"'`)
+		if value == "" {
+			continue
+		}
+		switch key {
+		case "memory_mib":
+			alloc.MemoryMiB, err = strconv.Atoi(value)
+		case "cpu_count":
+			alloc.CpuCount, err = strconv.Atoi(value)
+		case "cpu_pool":
+			alloc.CpuCount, err = countCpuPool(value)
+		}
+		if err != nil {
+			return nil, logex.Trace(err, fp, key)
+		}
+	}
+	return &alloc, nil
+}
+
+// countCpuPool counts the cpus in a list like "1,3,5-7".
+func countCpuPool(pool string) (int, error) {
+	count := 0
+	for _, item := range strings.Split(pool, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		sp := strings.SplitN(item, "-", 2)
+		start, err := strconv.Atoi(sp[0])
+		if err != nil {
+			return 0, logex.Trace(err)
+		}
+		end := start
+		if len(sp) == 2 {
+			end, err = strconv.Atoi(sp[1])
+			if err != nil {
+				return 0, logex.Trace(err)
+			}
+		}
+		if end < start {
+			return 0, logex.NewErrorf("invalid cpu range: %v", item)
+		}
+		count += end - start + 1
+	}
+	return count, nil
+}
+
+func (a *NitroAllocator) Check(cpus, mem int) error {
+	if a.CpuCount > 0 && cpus > a.CpuCount {
+		return logex.NewErrorf("enclave requires %v cpus, the allocator only reserves %v", cpus, a.CpuCount)
+	}
+	if a.MemoryMiB > 0 && mem > a.MemoryMiB {
+		return logex.NewErrorf("enclave requires %vMiB memory, the allocator only reserves %vMiB", mem, a.MemoryMiB)
+	}
+	return nil
+}
@@ -0,0 +1,216 @@
+package misc
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chzyer/logex"
+	"github.com/hf/nitrite"
+)
+
+// RATLSExtension is the private certificate extension carrying the
+// attestation document of the certificate's public key.
+var RATLSExtension = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 57264, 1, 1}
+
+// RATLSCertifier issues the certificates of a key created at startup, the
+// key never leaves the process. The attestation documents are short-lived,
+// so each tls handshake gets a certificate with a fresh attestation of the
+// key. The key is attested by attest unless it's nil.
+type RATLSCertifier struct {
+	key    *ecdsa.PrivateKey
+	pubkey []byte
+	attest func(pubkey []byte) ([]byte, error)
+}
+
+func NewRATLSCertifier(attest func(pubkey []byte) ([]byte, error)) (*RATLSCertifier, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, logex.Trace(err)
+	}
+	pubkey, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		return nil, logex.Trace(err)
+	}
+	return &RATLSCertifier{key: key, pubkey: pubkey, attest: attest}, nil
+}
+
+// Certificate creates a self-signed certificate of the key.
+func (c *RATLSCertifier) Certificate() (*tls.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, logex.Trace(err)
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "tee-compile"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(365 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if c.attest != nil {
+		doc, err := c.attest(c.pubkey)
+		if err != nil {
+			return nil, logex.Trace(err)
+		}
+		template.ExtraExtensions = []pkix.Extension{{Id: RATLSExtension, Value: doc}}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &c.key.PublicKey, c.key)
+	if err != nil {
+		return nil, logex.Trace(err)
+	}
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: c.key}, nil
+}
+
+// NewRATLSCertificate creates a self-signed certificate with a fresh key,
+// see RATLSCertifier.
+func NewRATLSCertificate(attest func(pubkey []byte) ([]byte, error)) (*tls.Certificate, error) {
+	c, err := NewRATLSCertifier(attest)
+	if err != nil {
+		return nil, logex.Trace(err)
+	}
+	return c.Certificate()
+}
+
+// GetCertificate is the tls.Config hook issuing a certificate per handshake.
+func (c *RATLSCertifier) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return c.Certificate()
+}
+
+type RATLSError struct {
+	Reason string
+}
+
+func (e *RATLSError) Error() string {
+	return "untrusted worker certificate: " + e.Reason
+}
+
+// RATLSVerifier accepts a certificate whose public key is attested by a
+// nitro enclave measured with PCRs. Without Required an unattested
+// certificate is accepted as well. The first attested key is pinned, the
+// later connections must reach the same worker.
+type RATLSVerifier struct {
+	PCRs     map[uint][]byte
+	Required bool
+	// SkipPCRs only checks the key is attested, debug enclaves report
+	// zeroed PCRs.
+	SkipPCRs bool
+
+	mu       sync.Mutex
+	pubkey   []byte
+	document *nitrite.Document
+}
+
+// Document returns the attestation of the pinned key, nil if the worker
+// isn't attested.
+func (v *RATLSVerifier) Document() *nitrite.Document {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.document
+}
+
+func (v *RATLSVerifier) TLSConfig() *tls.Config {
+	return &tls.Config{
+		// the certificate is self-signed, the attestation vouches for it
+		InsecureSkipVerify:    true,
+		VerifyPeerCertificate: v.VerifyPeerCertificate,
+		MinVersion:            tls.VersionTLS12,
+	}
+}
+
+func (v *RATLSVerifier) VerifyPeerCertificate(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	if len(rawCerts) == 0 {
+		return &RATLSError{"no certificate"}
+	}
+	cert, err := x509.ParseCertificate(rawCerts[0])
+	if err != nil {
+		return &RATLSError{err.Error()}
+	}
+	// the tls handshake proves the worker holds the key of the certificate
+	var doc []byte
+	for _, ext := range cert.Extensions {
+		if ext.Id.Equal(RATLSExtension) {
+			doc = ext.Value
+		}
+	}
+	if doc == nil {
+		if v.Required {
+			return &RATLSError{"the public key is not attested"}
+		}
+		return nil
+	}
+	result, err := nitrite.Verify(doc, nitrite.VerifyOptions{CurrentTime: time.Now()})
+	if err != nil {
+		return &RATLSError{err.Error()}
+	}
+	if !bytes.Equal(result.Document.PublicKey, cert.RawSubjectPublicKeyInfo) {
+		return &RATLSError{"the attested public key doesn't match the certificate"}
+	}
+	if !v.SkipPCRs {
+		for idx, expected := range v.PCRs {
+			if actual := result.Document.PCRs[idx]; !bytes.Equal(actual, expected) {
+				return &RATLSError{fmt.Sprintf("PCR%v mismatch: expected %x, attested %x", idx, expected, actual)}
+			}
+		}
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.pubkey != nil && !bytes.Equal(v.pubkey, cert.RawSubjectPublicKeyInfo) {
+		return &RATLSError{"the worker presents another attested key"}
+	}
+	v.pubkey = cert.RawSubjectPublicKeyInfo
+	v.document = result.Document
+	return nil
+}
+
+// CertFingerprint returns the hex sha256 of a der certificate.
+func CertFingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:])
+}
+
+// PinnedTLSConfig accepts only the certificate with the fingerprint, the
+// fingerprint comes from an already trusted channel.
+func PinnedTLSConfig(fingerprint string) *tls.Config {
+	return &tls.Config{
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 || CertFingerprint(rawCerts[0]) != fingerprint {
+				return logex.NewErrorf("unexpected peer certificate, expect %v", fingerprint)
+			}
+			return nil
+		},
+		MinVersion: tls.VersionTLS12,
+	}
+}
+
+// ParsePCRs decodes the hex PCR values, the empty ones are skipped.
+func ParsePCRs(pcrs map[uint]string) (map[uint][]byte, error) {
+	ret := make(map[uint][]byte)
+	for idx, value := range pcrs {
+		if value == "" {
+			continue
+		}
+		data, err := hex.DecodeString(strings.TrimPrefix(value, "0x"))
+		if err != nil {
+			return nil, logex.Trace(err, idx)
+		}
+		ret[idx] = data
+	}
+	return ret, nil
+}
@@ -0,0 +1,46 @@
+package misc
+
+import (
+	"bufio"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/chzyer/logex"
+)
+
+// MemTotal returns the total memory in MiB.
+func MemTotal() (int, error) {
+	fd, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0, logex.Trace(err)
+	}
+	defer fd.Close()
+
+	scanner := bufio.NewScanner(fd)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || fields[0] != "MemTotal:" {
+			continue
+		}
+		kb, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return 0, logex.Trace(err)
+		}
+		return kb / 1024, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, logex.Trace(err)
+	}
+	return 0, logex.NewErrorf("MemTotal not found")
+}
+
+// DiskFree returns the space available in dir in MiB.
+func DiskFree(dir string) (int, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return 0, logex.Trace(err)
+	}
+	return int(stat.Bavail * uint64(stat.Bsize) / 1024 / 1024), nil
+}
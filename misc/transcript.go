@@ -0,0 +1,91 @@
+package misc
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/chzyer/logex"
+)
+
+// Transcript records the commands and the output of a build. Once sealed
+// the later writes are ignored, so the digest covers exactly the file.
+type Transcript struct {
+	Path string
+
+	mu     sync.Mutex
+	fd     *os.File
+	hash   hash.Hash
+	digest string
+}
+
+func NewTranscript(fp string) (*Transcript, error) {
+	fd, err := os.OpenFile(fp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, logex.Trace(err)
+	}
+	return &Transcript{Path: fp, fd: fd, hash: sha256.New()}, nil
+}
+
+func (t *Transcript) Write(data []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.fd == nil {
+		return len(data), nil
+	}
+	n, err := t.fd.Write(data)
+	t.hash.Write(data[:n])
+	if err != nil {
+		return n, logex.Trace(err)
+	}
+	return n, nil
+}
+
+// Tee returns an output which writes to both out and the transcript.
+func (t *Transcript) Tee(out *LogOutput) *LogOutput {
+	out = out.withDefault()
+	return &LogOutput{
+		Stdout: io.MultiWriter(t, out.Stdout),
+		Stderr: io.MultiWriter(t, out.Stderr),
+	}
+}
+
+// Seal stops the recording and returns the sha256 of the transcript.
+func (t *Transcript) Seal() (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.fd == nil {
+		return t.digest, nil
+	}
+	err := t.fd.Close()
+	t.fd = nil
+	t.digest = fmt.Sprintf("0x%x", t.hash.Sum(nil))
+	if err != nil {
+		return "", logex.Trace(err)
+	}
+	return t.digest, nil
+}
+
+func (t *Transcript) Remove() error {
+	t.Seal()
+	if err := os.Remove(t.Path); err != nil && !os.IsNotExist(err) {
+		return logex.Trace(err)
+	}
+	return nil
+}
+
+func FileSha256(fp string) (string, error) {
+	fd, err := os.Open(fp)
+	if err != nil {
+		return "", logex.Trace(err)
+	}
+	defer fd.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, fd); err != nil {
+		return "", logex.Trace(err)
+	}
+	return fmt.Sprintf("0x%x", hash.Sum(nil)), nil
+}
@@ -0,0 +1,168 @@
+package misc
+
+import (
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+
+	"github.com/chzyer/logex"
+)
+
+type TreeEntryType string
+
+var (
+	TreeFile    TreeEntryType = "file"
+	TreeDir     TreeEntryType = "dir"
+	TreeSymlink TreeEntryType = "symlink"
+)
+
+// treeModeBits are the mode bits a tree keeps, the leaves commit to them.
+const treeModeBits = os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky
+
+// TreeEntry describes a path of a source tree, the file content is
+// referred to by its sha256.
+type TreeEntry struct {
+	Path   string        `json:"path"`
+	Type   TreeEntryType `json:"type"`
+	Mode   os.FileMode   `json:"mode"`
+	Size   int64         `json:"size,omitempty"`
+	Sha256 string        `json:"sha256,omitempty"`
+	Link   string        `json:"link,omitempty"`
+}
+
+// ScanTree lists the tree under root without following the symlinks, the
+// entries are sorted by path and the parents come first. The paths matched
+// by exclude, if any, are skipped. The sha256 of an
+// unchanged file comes from the cache if any.
+func ScanTree(root string, cache *HashCache, exclude func(path string) bool) ([]*TreeEntry, error) {
+	var entries []*TreeEntry
+	err := filepath.Walk(root, func(fp string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return logex.Trace(err)
+		}
+		rel, err := filepath.Rel(root, fp)
+		if err != nil {
+			return logex.Trace(err)
+		}
+		if rel == "." {
+			return nil
+		}
+		if exclude != nil && exclude(filepath.ToSlash(rel)) {
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		entry := &TreeEntry{Path: filepath.ToSlash(rel), Mode: fi.Mode() & treeModeBits}
+		switch {
+		case fi.IsDir():
+			entry.Type = TreeDir
+		case fi.Mode()&os.ModeSymlink != 0:
+			entry.Type = TreeSymlink
+			entry.Link, err = os.Readlink(fp)
+			if err != nil {
+				return logex.Trace(err)
+			}
+		case fi.Mode().IsRegular():
+			entry.Type = TreeFile
+			entry.Size = fi.Size()
+			entry.Sha256, err = cache.Hash(fp, "sha256", func() (string, error) {
+				return GetContentHash(root, rel)
+			})
+			if err != nil {
+				return logex.Trace(err)
+			}
+		default:
+			return logex.NewErrorf("unsupported file type: %v(%v)", rel, fi.Mode().Type())
+		}
+		entries = append(entries, entry)
+		return nil
+	})
+	if err != nil {
+		return nil, logex.Trace(err)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Path < entries[j].Path
+	})
+	return entries, nil
+}
+
+// MaterializeTree recreates the entries under dst, blob returns the file
+// holding the content of a sha256.
+func MaterializeTree(entries []*TreeEntry, blob func(sum string) string, dst string) error {
+	if err := os.MkdirAll(dst, 0755); err != nil {
+		return logex.Trace(err)
+	}
+	var dirs []*TreeEntry
+	symlinks := make(map[string]bool)
+	for _, entry := range entries {
+		fp := filepath.Join(dst, filepath.FromSlash(entry.Path))
+		if !IsSubPath(dst, fp) {
+			return logex.NewErrorf("path escapes the tree: %v", entry.Path)
+		}
+		// never write through a symlink created by the tree itself
+		clean := path.Clean("/" + entry.Path)
+		for parent := path.Dir(clean); parent != "/"; parent = path.Dir(parent) {
+			if symlinks[parent] {
+				return logex.NewErrorf("path escapes the tree: %v", entry.Path)
+			}
+		}
+		switch entry.Type {
+		case TreeDir:
+			// writable until the files are in place
+			if err := os.MkdirAll(fp, 0755); err != nil {
+				return logex.Trace(err)
+			}
+			dirs = append(dirs, entry)
+		case TreeSymlink:
+			if err := os.Symlink(entry.Link, fp); err != nil {
+				return logex.Trace(err)
+			}
+			symlinks[clean] = true
+		case TreeFile:
+			if err := copyFile(blob(entry.Sha256), fp, entry.Mode&treeModeBits); err != nil {
+				return logex.Trace(err, entry.Path)
+			}
+		default:
+			return logex.NewErrorf("unsupported file type: %v(%v)", entry.Path, entry.Type)
+		}
+	}
+	for _, dir := range dirs {
+		if err := os.Chmod(filepath.Join(dst, filepath.FromSlash(dir.Path)), dir.Mode&treeModeBits); err != nil {
+			return logex.Trace(err)
+		}
+	}
+	return nil
+}
+
+// IsSubPath reports whether fp is inside dir, both are cleaned first.
+func IsSubPath(dir, fp string) bool {
+	rel, err := filepath.Rel(dir, fp)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !filepath.IsAbs(rel) && (len(rel) < 3 || rel[:3] != ".."+string(filepath.Separator))
+}
+
+func copyFile(src, dst string, mode os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return logex.Trace(err)
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, mode)
+	if err != nil {
+		return logex.Trace(err)
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return logex.Trace(err)
+	}
+	if err := out.Close(); err != nil {
+		return logex.Trace(err)
+	}
+	// the umask may have dropped some bits
+	return logex.Trace(os.Chmod(dst, mode))
+}
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/automata-network/tee-compile/misc"
+	"github.com/chzyer/logex"
+)
+
+const poolEnclaveNamePrefix = "tee-compile-"
+
+type EnclaveSpec struct {
+	Image     string `json:"image"`
+	ImageSize int64  `json:"image_size"`
+	ImageTime int64  `json:"image_time"`
+	Cpus      int    `json:"cpus"`
+	Mem       int    `json:"mem"`
+	Debug     bool   `json:"debug"`
+}
+
+func NewEnclaveSpec(image string, cpus, mem int, debug bool) (*EnclaveSpec, error) {
+	image, err := filepath.Abs(image)
+	if err != nil {
+		return nil, logex.Trace(err)
+	}
+	fi, err := os.Stat(image)
+	if err != nil {
+		return nil, logex.Trace(err)
+	}
+	return &EnclaveSpec{
+		Image:     image,
+		ImageSize: fi.Size(),
+		ImageTime: fi.ModTime().UnixNano(),
+		Cpus:      cpus,
+		Mem:       mem,
+		Debug:     debug,
+	}, nil
+}
+
+type PoolEnclave struct {
+	ID        string       `json:"id"`
+	Name      string       `json:"name"`
+	CID       uint32       `json:"cid"`
+	Spec      *EnclaveSpec `json:"spec"`
+	Owner     int          `json:"owner,omitempty"`
+	CreatedAt time.Time    `json:"created_at"`
+	LastUsed  time.Time    `json:"last_used"`
+}
+
+type poolState struct {
+	Enclaves []*PoolEnclave `json:"enclaves"`
+}
+
+// EnclavePool keeps track of the enclaves launched by tee-compile on this
+// host. The state is shared between processes through a locked json file,
+// only the enclaves recorded there are ever terminated.
+type EnclavePool struct {
+	StateFile string
+	Size      int
+	CidBase   uint32
+}
+
+func DefaultPoolStateFile() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		home = os.TempDir()
+	}
+	return filepath.Join(home, ".tee-compile", "pool.json")
+}
+
+func NewEnclavePool(stateFile string, size int, cidBase uint32) *EnclavePool {
+	if stateFile == "" {
+		stateFile = DefaultPoolStateFile()
+	}
+	if size <= 0 {
+		size = 1
+	}
+	return &EnclavePool{StateFile: stateFile, Size: size, CidBase: cidBase}
+}
+
+func (p *EnclavePool) update(fn func(state *poolState) error) error {
+	if err := os.MkdirAll(filepath.Dir(p.StateFile), 0755); err != nil {
+		return logex.Trace(err)
+	}
+	unlock, err := misc.Flock(p.StateFile + ".lock")
+	if err != nil {
+		return logex.Trace(err)
+	}
+	defer unlock()
+
+	var state poolState
+	data, err := os.ReadFile(p.StateFile)
+	if err != nil && !os.IsNotExist(err) {
+		return logex.Trace(err)
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &state); err != nil {
+			return logex.Trace(err, p.StateFile)
+		}
+	}
+
+	if err := fn(&state); err != nil {
+		return logex.Trace(err)
+	}
+
+	data, err = json.MarshalIndent(&state, "", "\t")
+	if err != nil {
+		return logex.Trace(err)
+	}
+	tmp := p.StateFile + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return logex.Trace(err)
+	}
+	if err := os.Rename(tmp, p.StateFile); err != nil {
+		return logex.Trace(err)
+	}
+	return nil
+}
+
+// refresh drops the enclaves which are gone and releases the leases of
+// dead processes. It returns the cids used by all the running enclaves.
+func (p *EnclavePool) refresh(state *poolState) (map[uint32]bool, error) {
+	running, err := misc.DescribeNitroEnclaves()
+	if err != nil {
+		return nil, logex.Trace(err)
+	}
+	cids := make(map[uint32]bool)
+	alive := make(map[string]bool)
+	for _, enclave := range running {
+		cids[enclave.EnclaveCID] = true
+		alive[enclave.EnclaveID] = true
+	}
+	enclaves := state.Enclaves[:0]
+	for _, enclave := range state.Enclaves {
+		if !alive[enclave.ID] {
+			continue
+		}
+		if enclave.Owner != 0 && !misc.ProcessAlive(enclave.Owner) {
+			enclave.Owner = 0
+		}
+		enclaves = append(enclaves, enclave)
+	}
+	state.Enclaves = enclaves
+	return cids, nil
+}
+
+func (p *EnclavePool) launch(state *poolState, cids map[uint32]bool, spec *EnclaveSpec) (*PoolEnclave, error) {
+	cid := p.CidBase
+	for cids[cid] {
+		cid++
+	}
+	name := fmt.Sprintf("%v%v", poolEnclaveNamePrefix, cid)
+	logex.Infof("launching enclave %v: cid=%v, cpus=%v, mem=%vMiB", name, cid, spec.Cpus, spec.Mem)
+	enclave, err := misc.RunNitroEnclave(&misc.NitroEnclaveOption{
+		Name:  name,
+		Path:  spec.Image,
+		Cpus:  spec.Cpus,
+		Mem:   spec.Mem,
+		CID:   cid,
+		Debug: spec.Debug,
+	})
+	if err != nil {
+		return nil, logex.Trace(err)
+	}
+	now := time.Now()
+	item := &PoolEnclave{
+		ID:        enclave.EnclaveID,
+		Name:      name,
+		CID:       enclave.EnclaveCID,
+		Spec:      spec,
+		Owner:     os.Getpid(),
+		CreatedAt: now,
+		LastUsed:  now,
+	}
+	state.Enclaves = append(state.Enclaves, item)
+	return item, nil
+}
+
+func (p *EnclavePool) tryAcquire(spec *EnclaveSpec) (*PoolEnclave, error) {
+	var result *PoolEnclave
+	err := p.update(func(state *poolState) error {
+		cids, err := p.refresh(state)
+		if err != nil {
+			return logex.Trace(err)
+		}
+
+		var idle *PoolEnclave
+		for _, enclave := range state.Enclaves {
+			if enclave.Owner != 0 {
+				continue
+			}
+			if *enclave.Spec == *spec {
+				enclave.Owner = os.Getpid()
+				enclave.LastUsed = time.Now()
+				result = enclave
+				logex.Infof("reuse warm enclave %v: cid=%v", enclave.ID, enclave.CID)
+				return nil
+			}
+			if idle == nil || enclave.LastUsed.Before(idle.LastUsed) {
+				idle = enclave
+			}
+		}
+
+		if len(state.Enclaves) >= p.Size {
+			if idle == nil {
+				return nil
+			}
+			// recycle the least recently used idle enclave
+			if err := p.terminate(state, idle.ID); err != nil {
+				return logex.Trace(err)
+			}
+			delete(cids, idle.CID)
+		}
+		result, err = p.launch(state, cids, spec)
+		if err != nil {
+			return logex.Trace(err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, logex.Trace(err)
+	}
+	return result, nil
+}
+
+// Acquire leases an enclave matching the spec, it reuses an idle one if
+// possible and waits up to timeout when all the enclaves are busy.
+func (p *EnclavePool) Acquire(spec *EnclaveSpec, timeout time.Duration) (*PoolEnclave, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		enclave, err := p.tryAcquire(spec)
+		if err != nil {
+			return nil, logex.Trace(err)
+		}
+		if enclave != nil {
+			return enclave, nil
+		}
+		if time.Now().After(deadline) {
+			return nil, logex.NewErrorf("all %v enclaves in the pool are busy", p.Size)
+		}
+		logex.Infof("all %v enclaves in the pool are busy, retry in 5secs", p.Size)
+		time.Sleep(5 * time.Second)
+	}
+}
+
+// Release gives the enclave back to the pool, it's terminated unless keep
+// is set. A kept enclave is reused as is, every build runs in a workspace
+// and a home of its own which the worker removes afterwards.
+func (p *EnclavePool) Release(enclave *PoolEnclave, keep bool) error {
+	return p.update(func(state *poolState) error {
+		if !keep {
+			return p.terminate(state, enclave.ID)
+		}
+		for _, item := range state.Enclaves {
+			if item.ID == enclave.ID {
+				item.Owner = 0
+				item.LastUsed = time.Now()
+			}
+		}
+		return nil
+	})
+}
+
+// terminate stops an enclave of the pool and forgets it, an enclave which
+// has already exited is only forgotten.
+func (p *EnclavePool) terminate(state *poolState, id string) error {
+	for idx, enclave := range state.Enclaves {
+		if enclave.ID != id {
+			continue
+		}
+		logex.Infof("terminating enclave %v", id)
+		if err := misc.TerminateNitroEnclave(id); err != nil {
+			running, describeErr := misc.DescribeNitroEnclaves()
+			if describeErr != nil || nitroEnclaveRunning(running, id) {
+				return logex.Trace(err)
+			}
+			logex.Infof("enclave %v is already gone", id)
+		}
+		state.Enclaves = append(state.Enclaves[:idx], state.Enclaves[idx+1:]...)
+		return nil
+	}
+	return logex.NewErrorf("enclave %v is not owned by the pool", id)
+}
+
+func nitroEnclaveRunning(enclaves []*misc.NitroEnclave, id string) bool {
+	for _, enclave := range enclaves {
+		if enclave.EnclaveID == id {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *EnclavePool) Terminate(ids []string) error {
+	return p.update(func(state *poolState) error {
+		if _, err := p.refresh(state); err != nil {
+			return logex.Trace(err)
+		}
+		for _, id := range ids {
+			if err := p.terminate(state, id); err != nil {
+				return logex.Trace(err)
+			}
+		}
+		return nil
+	})
+}
+
+func (p *EnclavePool) List() ([]*PoolEnclave, error) {
+	var enclaves []*PoolEnclave
+	if err := p.update(func(state *poolState) error {
+		if _, err := p.refresh(state); err != nil {
+			return logex.Trace(err)
+		}
+		enclaves = state.Enclaves
+		return nil
+	}); err != nil {
+		return nil, logex.Trace(err)
+	}
+	sort.Slice(enclaves, func(i, j int) bool {
+		return enclaves[i].CID < enclaves[j].CID
+	})
+	return enclaves, nil
+}
+
+type BuildToolPool struct {
+	List      *BuildToolPoolList      `flagly:"handler"`
+	Terminate *BuildToolPoolTerminate `flagly:"handler"`
+}
+
+type BuildToolPoolList struct {
+	Pool string
+}
+
+func (h *BuildToolPoolList) FlaglyHandle() error {
+	enclaves, err := NewEnclavePool(h.Pool, 0, 0).List()
+	if err != nil {
+		return logex.Trace(err)
+	}
+	for _, enclave := range enclaves {
+		state := "idle"
+		if enclave.Owner != 0 {
+			state = fmt.Sprintf("busy(pid=%v)", enclave.Owner)
+		}
+		fmt.Printf("%v\tcid=%v\tcpus=%v\tmem=%v\t%v\t%v\n",
+			enclave.ID, enclave.CID, enclave.Spec.Cpus, enclave.Spec.Mem, state, enclave.Spec.Image)
+	}
+	return nil
+}
+
+type BuildToolPoolTerminate struct {
+	Pool string
+	All  bool
+	ID   []string `type:"[]"`
+}
+
+func (h *BuildToolPoolTerminate) FlaglyHandle() error {
+	pool := NewEnclavePool(h.Pool, 0, 0)
+	ids := h.ID
+	if h.All {
+		enclaves, err := pool.List()
+		if err != nil {
+			return logex.Trace(err)
+		}
+		ids = nil
+		for _, enclave := range enclaves {
+			ids = append(ids, enclave.ID)
+		}
+	}
+	if err := pool.Terminate(ids); err != nil {
+		return logex.Trace(err)
+	}
+	return nil
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/automata-network/tee-compile/api"
+	"github.com/automata-network/tee-compile/misc"
+	"github.com/chzyer/logex"
+)
+
+type JobState string
+
+var (
+	JobPreparing JobState = "preparing"
+	JobQueued    JobState = "queued"
+	JobRunning   JobState = "running"
+	JobFinished  JobState = "finished"
+	JobFailed    JobState = "failed"
+)
+
+type Job struct {
+	ID         string     `json:"id"`
+	Nonce      string     `json:"nonce,omitempty"`
+	State      JobState   `json:"state"`
+	Cpus       int        `json:"cpus"`
+	Mem        int        `json:"mem"`
+	CreatedAt  time.Time  `json:"created_at"`
+	QueuedAt   *time.Time `json:"queued_at,omitempty"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	Error      string     `json:"error,omitempty"`
+
+	Transcript *misc.Transcript `json:"-"`
+	ready      chan struct{}
+}
+
+// Scheduler runs at most Jobs builds at once and only starts a build when
+// the cpus and memory(MiB) it asks for are still available. Jobs are started
+// in FIFO order so a big build can't be starved by small ones.
+type Scheduler struct {
+	Jobs int
+	Cpus int
+	Mem  int
+
+	mu       sync.Mutex
+	seq      int
+	running  int
+	usedCpus int
+	usedMem  int
+	queue    []*Job
+	jobs     []*Job
+	history  int
+}
+
+func NewScheduler(jobs, cpus, mem int) *Scheduler {
+	if jobs <= 0 {
+		jobs = 1
+	}
+	return &Scheduler{Jobs: jobs, Cpus: cpus, Mem: mem, history: 100}
+}
+
+func (s *Scheduler) NewJob(nonce string) *Job {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.seq++
+	job := &Job{
+		ID:        fmt.Sprintf("%d", s.seq),
+		Nonce:     nonce,
+		State:     JobPreparing,
+		CreatedAt: time.Now(),
+		ready:     make(chan struct{}),
+	}
+	s.jobs = append(s.jobs, job)
+	s.gc()
+	return job
+}
+
+// Run waits until the job fits into the free capacity, then runs fn.
+func (s *Scheduler) Run(job *Job, cpus, mem int, fn func() error) error {
+	if err := s.enqueue(job, cpus, mem); err != nil {
+		return logex.Trace(err)
+	}
+	<-job.ready
+
+	// a panic of fn must not keep the capacity
+	defer func() {
+		s.mu.Lock()
+		s.running--
+		s.usedCpus -= job.Cpus
+		s.usedMem -= job.Mem
+		s.schedule()
+		s.mu.Unlock()
+	}()
+	return fn()
+}
+
+func (s *Scheduler) enqueue(job *Job, cpus, mem int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.Cpus > 0 && cpus > s.Cpus {
+		return api.WithStatus(logex.NewErrorf("job requires %v cpus, worker has %v", cpus, s.Cpus), http.StatusBadRequest)
+	}
+	if s.Mem > 0 && mem > s.Mem {
+		return api.WithStatus(logex.NewErrorf("job requires %vMiB memory, worker has %vMiB", mem, s.Mem), http.StatusBadRequest)
+	}
+	now := time.Now()
+	job.Cpus = cpus
+	job.Mem = mem
+	job.State = JobQueued
+	job.QueuedAt = &now
+	s.queue = append(s.queue, job)
+	s.schedule()
+	return nil
+}
+
+func (s *Scheduler) schedule() {
+	for len(s.queue) > 0 {
+		job := s.queue[0]
+		if s.running >= s.Jobs {
+			return
+		}
+		if s.Cpus > 0 && s.usedCpus+job.Cpus > s.Cpus {
+			return
+		}
+		if s.Mem > 0 && s.usedMem+job.Mem > s.Mem {
+			return
+		}
+		s.queue = s.queue[1:]
+		now := time.Now()
+		s.running++
+		s.usedCpus += job.Cpus
+		s.usedMem += job.Mem
+		job.State = JobRunning
+		job.StartedAt = &now
+		close(job.ready)
+	}
+}
+
+// SetTranscript attaches the transcript of the build to the job.
+func (s *Scheduler) SetTranscript(job *Job, transcript *misc.Transcript) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job.Transcript = transcript
+}
+
+func (s *Scheduler) Done(job *Job, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	job.FinishedAt = &now
+	if err != nil {
+		job.State = JobFailed
+		job.Error = err.Error()
+	} else {
+		job.State = JobFinished
+	}
+}
+
+// gc drops the oldest finished jobs once the history is full.
+func (s *Scheduler) gc() {
+	finished := 0
+	for _, job := range s.jobs {
+		if job.FinishedAt != nil {
+			finished++
+		}
+	}
+	jobs := s.jobs[:0]
+	for _, job := range s.jobs {
+		if job.FinishedAt != nil && finished > s.history {
+			finished--
+			if job.Transcript != nil {
+				job.Transcript.Remove()
+			}
+			continue
+		}
+		jobs = append(jobs, job)
+	}
+	s.jobs = jobs
+}
+
+// Transcript returns the transcript of a finished job.
+func (s *Scheduler) Transcript(id string) (*misc.Transcript, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, job := range s.jobs {
+		if job.ID != id || job.Transcript == nil {
+			continue
+		}
+		if job.FinishedAt == nil {
+			return nil, api.WithStatus(logex.NewErrorf("job %v is still running", id), http.StatusConflict)
+		}
+		return job.Transcript, nil
+	}
+	return nil, api.WithStatus(logex.NewErrorf("job %q not found", id), http.StatusNotFound)
+}
+
+func (s *Scheduler) List() []Job {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]Job, 0, len(s.jobs))
+	for _, job := range s.jobs {
+		item := *job
+		item.ready = nil
+		item.Transcript = nil
+		list = append(list, item)
+	}
+	return list
+}
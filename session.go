@@ -0,0 +1,159 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/automata-network/tee-compile/api"
+	"github.com/automata-network/tee-compile/misc"
+	"github.com/chzyer/logex"
+)
+
+// Session is the lease of the worker by one host, it's opened by the
+// handshake and every later request carries its token. The uploads, the
+// sources and the logs of a session are its own, several sessions share
+// the worker.
+type Session struct {
+	Token     string
+	Host      string
+	CreatedAt time.Time
+	Uploads   *UploadStore
+	Logs      *misc.LogRouter
+	Logger    *logex.Logger
+
+	lastSeen time.Time
+	active   int
+
+	mu      sync.Mutex
+	sources map[string]bool
+}
+
+// AddSource records a source of the blob store as one of the session.
+func (s *Session) AddSource(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.sources == nil {
+		s.sources = make(map[string]bool)
+	}
+	s.sources[id] = true
+}
+
+// Source checks the source belongs to the session.
+func (s *Session) Source(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.sources[id] {
+		return api.WithStatus(logex.NewErrorf("source %q not found", id), http.StatusNotFound)
+	}
+	return nil
+}
+
+// Sources returns the ids of the sources of the session.
+func (s *Session) Sources() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ids := make([]string, 0, len(s.sources))
+	for id := range s.sources {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// SessionManager holds the open sessions by their token. A session is
+// dropped when its host closes it, or after it has been idle for Timeout so
+// that a crashed host doesn't leak its uploads. OnClose releases what a
+// dropped session holds.
+type SessionManager struct {
+	Timeout time.Duration
+	OnClose func(session *Session)
+
+	mu       sync.Mutex
+	sessions map[string]*Session
+}
+
+func NewSessionManager(timeout time.Duration, onClose func(session *Session)) *SessionManager {
+	return &SessionManager{
+		Timeout:  timeout,
+		OnClose:  onClose,
+		sessions: make(map[string]*Session),
+	}
+}
+
+// expire drops the idle sessions, it returns them to be closed once the
+// lock is released.
+func (m *SessionManager) expire() []*Session {
+	var expired []*Session
+	for token, session := range m.sessions {
+		if session.active == 0 && time.Since(session.lastSeen) > m.Timeout {
+			delete(m.sessions, token)
+			expired = append(expired, session)
+		}
+	}
+	return expired
+}
+
+func (m *SessionManager) close(sessions []*Session) {
+	if m.OnClose == nil {
+		return
+	}
+	for _, session := range sessions {
+		m.OnClose(session)
+	}
+}
+
+// Open registers the session under a new token.
+func (m *SessionManager) Open(session *Session) (*Session, error) {
+	var token [32]byte
+	if _, err := rand.Read(token[:]); err != nil {
+		return nil, logex.Trace(err)
+	}
+	now := time.Now()
+	session.Token = hex.EncodeToString(token[:])
+	session.CreatedAt = now
+	session.lastSeen = now
+
+	m.mu.Lock()
+	expired := m.expire()
+	m.sessions[session.Token] = session
+	m.mu.Unlock()
+	m.close(expired)
+	return session, nil
+}
+
+// Authorize returns the session of the token of req, the returned func
+// must be called once the request is served.
+func (m *SessionManager) Authorize(req *http.Request) (*Session, func(), error) {
+	m.mu.Lock()
+	expired := m.expire()
+	session, ok := m.sessions[api.Token(req)]
+	if ok {
+		session.active++
+	}
+	m.mu.Unlock()
+	m.close(expired)
+	if !ok {
+		return nil, nil, api.WithStatus(logex.NewErrorf("invalid session token, handshake first"), http.StatusUnauthorized)
+	}
+	return session, func() {
+		m.mu.Lock()
+		session.active--
+		session.lastSeen = time.Now()
+		m.mu.Unlock()
+	}, nil
+}
+
+// Close drops the session of the token of req.
+func (m *SessionManager) Close(req *http.Request) error {
+	m.mu.Lock()
+	session, ok := m.sessions[api.Token(req)]
+	delete(m.sessions, api.Token(req))
+	m.mu.Unlock()
+	if !ok {
+		return api.WithStatus(logex.NewErrorf("invalid session token"), http.StatusUnauthorized)
+	}
+	m.close([]*Session{session})
+	return nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/automata-network/tee-compile/api"
+)
+
+func sessionRequest(token string) *http.Request {
+	req, _ := http.NewRequest(http.MethodPost, "/", nil)
+	api.SetToken(req, token)
+	return req
+}
+
+func TestSessionManagerSessions(t *testing.T) {
+	var closed []*Session
+	m := NewSessionManager(time.Minute, func(session *Session) {
+		closed = append(closed, session)
+	})
+	first, err := m.Open(&Session{Host: "first"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := m.Open(&Session{Host: "second"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Token == second.Token {
+		t.Fatal("sessions share a token")
+	}
+	first.AddSource("1")
+	if err := second.Source("1"); err == nil {
+		t.Fatal("a session sees the source of another one")
+	}
+
+	for _, session := range []*Session{first, second} {
+		got, release, err := m.Authorize(sessionRequest(session.Token))
+		if err != nil {
+			t.Fatal(err)
+		}
+		release()
+		if got != session {
+			t.Fatalf("token of %v authorizes %v", session.Host, got.Host)
+		}
+	}
+	if _, _, err := m.Authorize(sessionRequest("bad")); err == nil {
+		t.Fatal("an unknown token is authorized")
+	}
+
+	if err := m.Close(sessionRequest(first.Token)); err != nil {
+		t.Fatal(err)
+	}
+	if len(closed) != 1 || closed[0] != first {
+		t.Fatalf("closed %v sessions", len(closed))
+	}
+	if _, _, err := m.Authorize(sessionRequest(first.Token)); err == nil {
+		t.Fatal("a closed session is authorized")
+	}
+	if _, release, err := m.Authorize(sessionRequest(second.Token)); err != nil {
+		t.Fatal(err)
+	} else {
+		release()
+	}
+}
+
+func TestSessionManagerExpire(t *testing.T) {
+	var closed []*Session
+	m := NewSessionManager(time.Millisecond, func(session *Session) {
+		closed = append(closed, session)
+	})
+	idle, err := m.Open(&Session{Host: "idle"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	busy, err := m.Open(&Session{Host: "busy"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, release, err := m.Authorize(sessionRequest(busy.Token))
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if _, err := m.Open(&Session{Host: "other"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(closed) != 1 || closed[0] != idle {
+		t.Fatalf("expired %v sessions", len(closed))
+	}
+	release()
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/automata-network/tee-compile/api"
+	"github.com/automata-network/tee-compile/misc"
+	"github.com/chzyer/logex"
+)
+
+type StartupState string
+
+var (
+	StartupBooting StartupState = "booting"
+	StartupReady   StartupState = "ready"
+	StartupExited  StartupState = "exited"
+	StartupTimeout StartupState = "timeout"
+	// the worker answered but the handshake failed
+	StartupRejected StartupState = "rejected"
+)
+
+// Startup waits for the worker to answer the ping. It gives up when the
+// worker exits or the deadline passes, and dumps the console output so the
+// boot failure can be diagnosed.
+type Startup struct {
+	Timeout    time.Duration
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	Ping       func() error
+	Exited     func() (bool, error)
+	Console    *misc.TailBuffer
+
+	State StartupState
+}
+
+func (s *Startup) Wait() error {
+	deadline := time.Now().Add(s.Timeout)
+	backoff := s.MinBackoff
+	s.setState(StartupBooting)
+	for attempt := 1; ; attempt++ {
+		err := s.Ping()
+		if err == nil {
+			s.setState(StartupReady)
+			return nil
+		}
+		switch err.(type) {
+		case *api.Error, *misc.RATLSError:
+			// the worker is up but we refuse to talk to each other
+			s.setState(StartupRejected)
+			return err
+		}
+
+		exited, exitErr := s.Exited()
+		if exitErr != nil {
+			return logex.Trace(exitErr)
+		}
+		if exited {
+			s.setState(StartupExited)
+			return s.fail("worker exited during startup")
+		}
+		if time.Now().After(deadline) {
+			s.setState(StartupTimeout)
+			return s.fail(fmt.Sprintf("worker is not ready after %v: %v", s.Timeout, err))
+		}
+
+		wait := jitter(backoff)
+		if remain := time.Until(deadline); wait > remain {
+			wait = remain
+		}
+		logex.Infof("connecting to the worker(attempt %v)... retry in %v", attempt, wait.Round(time.Millisecond))
+		time.Sleep(wait)
+		backoff *= 2
+		if backoff > s.MaxBackoff {
+			backoff = s.MaxBackoff
+		}
+	}
+}
+
+func (s *Startup) setState(state StartupState) {
+	s.State = state
+	logex.Infof("worker state: %v", state)
+}
+
+func (s *Startup) fail(msg string) error {
+	if s.Console == nil {
+		logex.Error("console output is only available in debug mode")
+	} else if console := s.Console.Bytes(); len(console) > 0 {
+		logex.Errorf("console output:\n%s", console)
+	}
+	return logex.NewError(msg)
+}
+
+// jitter spreads d randomly over [d/2, 3d/2).
+func jitter(d time.Duration) time.Duration {
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d)))
+}
+
+func nitroEnclaveExited(id string) func() (bool, error) {
+	return func() (bool, error) {
+		enclaves, err := misc.DescribeNitroEnclaves()
+		if err != nil {
+			return false, logex.Trace(err)
+		}
+		for _, enclave := range enclaves {
+			if enclave.EnclaveID == id {
+				return enclave.State != "RUNNING", nil
+			}
+		}
+		return true, nil
+	}
+}
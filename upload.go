@@ -0,0 +1,389 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/automata-network/tee-compile/api"
+	"github.com/automata-network/tee-compile/misc"
+	"github.com/chzyer/logex"
+)
+
+type upload struct {
+	mu     sync.Mutex
+	status api.UploadStatus
+	path   string
+	hash   hash.Hash
+}
+
+// UploadStore keeps the chunked uploads of a session. A chunk
+// is only appended once its sha256 matches, and an upload is only handed
+// to a build after the whole object is verified by Commit.
+type UploadStore struct {
+	Dir string
+
+	mu      sync.Mutex
+	seq     int
+	uploads map[string]*upload
+}
+
+func NewUploadStore(dir string) (*UploadStore, error) {
+	if err := os.RemoveAll(dir); err != nil {
+		return nil, logex.Trace(err)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, logex.Trace(err)
+	}
+	return &UploadStore{Dir: dir, uploads: make(map[string]*upload)}, nil
+}
+
+func (s *UploadStore) get(id string) (*upload, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.uploads[id]
+	if !ok {
+		return nil, api.WithStatus(logex.NewErrorf("upload %q not found", id), http.StatusNotFound)
+	}
+	return u, nil
+}
+
+func (s *UploadStore) Create(req *api.UploadRequest) (*api.UploadStatus, error) {
+	if req.Size < 0 {
+		return nil, api.WithStatus(logex.NewErrorf("invalid size: %v", req.Size), http.StatusBadRequest)
+	}
+	if sum, err := hex.DecodeString(req.Sha256); err != nil || len(sum) != sha256.Size {
+		return nil, api.WithStatus(logex.NewErrorf("invalid sha256: %q", req.Sha256), http.StatusBadRequest)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.seq++
+	id := fmt.Sprint(s.seq)
+	u := &upload{
+		status: api.UploadStatus{ID: id, Size: req.Size, Sha256: req.Sha256},
+		path:   filepath.Join(s.Dir, "upload-"+id),
+		hash:   sha256.New(),
+	}
+	if err := os.WriteFile(u.path, nil, 0644); err != nil {
+		return nil, logex.Trace(err)
+	}
+	s.uploads[id] = u
+	status := u.status
+	return &status, nil
+}
+
+// Append writes the chunk at offset, which must be the current offset of
+// the upload.
+func (s *UploadStore) Append(id string, offset int64, sum string, body io.Reader) (*api.UploadStatus, error) {
+	u, err := s.get(id)
+	if err != nil {
+		return nil, logex.Trace(err)
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.status.Committed {
+		return nil, api.WithStatus(logex.NewErrorf("upload %v is committed", id), http.StatusConflict)
+	}
+	if offset != u.status.Offset {
+		return nil, api.WithStatus(logex.NewErrorf(
+			"upload %v expects offset %v, got %v", id, u.status.Offset, offset,
+		), http.StatusConflict)
+	}
+
+	chunk, err := io.ReadAll(io.LimitReader(body, api.MaxChunkSize+1))
+	if err != nil {
+		return nil, logex.Trace(err)
+	}
+	if len(chunk) > api.MaxChunkSize {
+		return nil, api.WithStatus(logex.NewErrorf("chunk exceeds %v bytes", api.MaxChunkSize), http.StatusBadRequest)
+	}
+	if offset+int64(len(chunk)) > u.status.Size {
+		return nil, api.WithStatus(logex.NewErrorf("chunk exceeds the upload size %v", u.status.Size), http.StatusBadRequest)
+	}
+	if actual := sha256.Sum256(chunk); hex.EncodeToString(actual[:]) != sum {
+		return nil, api.WithStatus(logex.NewErrorf("chunk sha256 mismatch at offset %v", offset), http.StatusBadRequest)
+	}
+
+	fd, err := os.OpenFile(u.path, os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, logex.Trace(err)
+	}
+	defer fd.Close()
+	if _, err := fd.WriteAt(chunk, offset); err != nil {
+		return nil, logex.Trace(err)
+	}
+	u.hash.Write(chunk)
+	u.status.Offset += int64(len(chunk))
+	status := u.status
+	return &status, nil
+}
+
+func (s *UploadStore) Status(id string) (*api.UploadStatus, error) {
+	u, err := s.get(id)
+	if err != nil {
+		return nil, logex.Trace(err)
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	status := u.status
+	return &status, nil
+}
+
+// Commit checks the whole object, a corrupted upload is dropped.
+func (s *UploadStore) Commit(id string) (*api.UploadStatus, error) {
+	u, err := s.get(id)
+	if err != nil {
+		return nil, logex.Trace(err)
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.status.Offset != u.status.Size {
+		return nil, api.WithStatus(logex.NewErrorf(
+			"upload %v is incomplete: %v/%v bytes", id, u.status.Offset, u.status.Size,
+		), http.StatusConflict)
+	}
+	if !u.status.Committed {
+		expected, _ := hex.DecodeString(u.status.Sha256)
+		if !bytes.Equal(u.hash.Sum(nil), expected) {
+			s.remove(id)
+			return nil, api.WithStatus(logex.NewErrorf("upload %v sha256 mismatch", id), http.StatusBadRequest)
+		}
+		if err := os.Truncate(u.path, u.status.Size); err != nil {
+			return nil, logex.Trace(err)
+		}
+		u.status.Committed = true
+	}
+	status := u.status
+	return &status, nil
+}
+
+// Take hands a committed upload over, the caller removes the file.
+func (s *UploadStore) Take(id string) (string, error) {
+	u, err := s.get(id)
+	if err != nil {
+		return "", logex.Trace(err)
+	}
+	u.mu.Lock()
+	committed := u.status.Committed
+	u.mu.Unlock()
+	if !committed {
+		return "", api.WithStatus(logex.NewErrorf("upload %v is not committed", id), http.StatusConflict)
+	}
+	s.mu.Lock()
+	delete(s.uploads, id)
+	s.mu.Unlock()
+	return u.path, nil
+}
+
+func (s *UploadStore) remove(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if u, ok := s.uploads[id]; ok {
+		os.Remove(u.path)
+		delete(s.uploads, id)
+	}
+}
+
+// Clear drops all the uploads, it's called when the session is closed.
+func (s *UploadStore) Clear() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, u := range s.uploads {
+		os.Remove(u.path)
+		delete(s.uploads, id)
+	}
+}
+
+// Uploader sends a file to the worker in chunks. A failed chunk is sent
+// again from the offset the worker reports, so a dropped connection
+// resumes the upload instead of restarting it.
+type Uploader struct {
+	Client   *http.Client
+	Endpoint string
+	Retries  int
+}
+
+func (u *Uploader) do(method, path string, query url.Values, header http.Header, body io.Reader, result interface{}) error {
+	req, err := http.NewRequest(method, u.Endpoint+path+"?"+query.Encode(), body)
+	if err != nil {
+		return logex.Trace(err)
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	response, err := u.Client.Do(req)
+	if err != nil {
+		return logex.Trace(err)
+	}
+	defer response.Body.Close()
+	if err := api.CheckResponse(response); err != nil {
+		return err
+	}
+	if err := json.NewDecoder(response.Body).Decode(result); err != nil {
+		return logex.Trace(err)
+	}
+	return nil
+}
+
+// Upload returns the id of the committed upload.
+func (u *Uploader) Upload(fp string) (string, error) {
+	fd, err := os.Open(fp)
+	if err != nil {
+		return "", logex.Trace(err)
+	}
+	defer fd.Close()
+	hash := sha256.New()
+	size, err := io.Copy(hash, fd)
+	if err != nil {
+		return "", logex.Trace(err)
+	}
+	body, err := json.Marshal(&api.UploadRequest{Size: size, Sha256: hex.EncodeToString(hash.Sum(nil))})
+	if err != nil {
+		return "", logex.Trace(err)
+	}
+	var status api.UploadStatus
+	if err := u.do(http.MethodPost, api.PathUploads, nil, nil, bytes.NewReader(body), &status); err != nil {
+		return "", logex.Trace(err)
+	}
+
+	chunk := make([]byte, api.ChunkSize)
+	failures := 0
+	for status.Offset < status.Size {
+		n, err := fd.ReadAt(chunk, status.Offset)
+		if err != nil && err != io.EOF {
+			return "", logex.Trace(err)
+		}
+		sum := sha256.Sum256(chunk[:n])
+		query := url.Values{"id": {status.ID}, "offset": {fmt.Sprint(status.Offset)}}
+		header := http.Header{api.HeaderChunkSha256: {hex.EncodeToString(sum[:])}}
+		err = u.do(http.MethodPut, api.PathUploadChunk, query, header, bytes.NewReader(chunk[:n]), &status)
+		if err == nil {
+			failures = 0
+			continue
+		}
+		if apiErr, ok := err.(*api.Error); ok && (apiErr.Status == http.StatusNotFound || apiErr.Status == http.StatusUnauthorized) {
+			return "", apiErr
+		}
+		failures++
+		if failures > u.Retries {
+			return "", logex.Trace(err, fp)
+		}
+		logex.Errorf("upload %v failed at offset %v, resuming(%v/%v): %v", fp, status.Offset, failures, u.Retries, err)
+		time.Sleep(time.Duration(failures) * time.Second)
+		// the chunk may have landed before the connection dropped
+		var current api.UploadStatus
+		if err := u.do(http.MethodGet, api.PathUploadStatus, url.Values{"id": {status.ID}}, nil, nil, &current); err == nil {
+			status = current
+		}
+	}
+
+	if err := u.do(http.MethodPost, api.PathUploadCommit, url.Values{"id": {status.ID}}, nil, nil, &status); err != nil {
+		return "", logex.Trace(err, fp)
+	}
+	return status.ID, nil
+}
+
+// UploadSource sends the entries scanned from the tree under root and
+// uploads only the blobs the worker lacks. It returns the id of the source
+// to build.
+func (u *Uploader) UploadSource(root string, entries []*misc.TreeEntry) (string, error) {
+	body, err := json.Marshal(&api.SourceManifest{Entries: entries})
+	if err != nil {
+		return "", logex.Trace(err)
+	}
+	var status api.SourceStatus
+	if err := u.do(http.MethodPost, api.PathSources, nil, nil, bytes.NewReader(body), &status); err != nil {
+		return "", logex.Trace(err)
+	}
+	logex.Infof("source: %v entries, %v blobs missing on the worker", len(entries), len(status.Missing))
+	if len(status.Missing) == 0 {
+		return status.ID, nil
+	}
+
+	files := make(map[string]string)
+	for _, entry := range entries {
+		if entry.Type == misc.TreeFile {
+			files[entry.Sha256] = entry.Path
+		}
+	}
+	blobs, err := tarBlobs(root, status.Missing, files)
+	if err != nil {
+		return "", logex.Trace(err)
+	}
+	defer os.Remove(blobs)
+	id, err := u.Upload(blobs)
+	if err != nil {
+		return "", logex.Trace(err)
+	}
+	query := url.Values{"upload": {id}, "source": {status.ID}}
+	if err := u.do(http.MethodPost, api.PathBlobs, query, nil, nil, &status); err != nil {
+		return "", logex.Trace(err)
+	}
+	if len(status.Missing) > 0 {
+		return "", logex.NewErrorf("worker still lacks %v blobs of the source", len(status.Missing))
+	}
+	return status.ID, nil
+}
+
+// tarBlobs packs the files of the sums into a tarball, each entry is named
+// by the sha256 of its content.
+func tarBlobs(root string, sums []string, files map[string]string) (string, error) {
+	fd, err := os.CreateTemp("", "blobs-*.tar")
+	if err != nil {
+		return "", logex.Trace(err)
+	}
+	defer fd.Close()
+	tw := tar.NewWriter(fd)
+	for _, sum := range sums {
+		fp, ok := files[sum]
+		if !ok {
+			os.Remove(fd.Name())
+			return "", logex.NewErrorf("unknown blob: %v", sum)
+		}
+		if err := tarBlob(tw, sum, filepath.Join(root, fp)); err != nil {
+			os.Remove(fd.Name())
+			return "", logex.Trace(err, fp)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		os.Remove(fd.Name())
+		return "", logex.Trace(err)
+	}
+	return fd.Name(), nil
+}
+
+func tarBlob(tw *tar.Writer, sum, fp string) error {
+	src, err := os.Open(fp)
+	if err != nil {
+		return logex.Trace(err)
+	}
+	defer src.Close()
+	fi, err := src.Stat()
+	if err != nil {
+		return logex.Trace(err)
+	}
+	if err := tw.WriteHeader(&tar.Header{
+		Name:     sum,
+		Typeflag: tar.TypeReg,
+		Mode:     0644,
+		Size:     fi.Size(),
+	}); err != nil {
+		return logex.Trace(err)
+	}
+	if _, err := io.Copy(tw, src); err != nil {
+		return logex.Trace(err)
+	}
+	return nil
+}
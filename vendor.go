@@ -1,26 +1,26 @@
 package main
 
 import (
-	"os"
-
 	"github.com/automata-network/tee-compile/build"
 	"github.com/chzyer/logex"
 )
 
 type BuildToolVendor struct {
-	Dir string `default:"."`
+	Dir      string `default:"."`
+	Manifest string `default:"build.json" desc:"path of the manifest in -dir"`
+	BaseEnv  string `default:"/etc/tee-compile/env" desc:"base environment of the vendor command"`
 }
 
 func (b *BuildToolVendor) FlaglyHandle() error {
-	if err := os.Chdir(b.Dir); err != nil {
+	manifest, err := build.LoadManifest(b.Dir, b.Manifest)
+	if err != nil {
 		return logex.Trace(err)
 	}
-
-	manifest, err := build.NewManifest("build.json")
+	builder := build.NewBuilder(b.Dir, manifest, "", nil)
+	builder.BaseEnv, err = build.LoadBaseEnv(b.BaseEnv)
 	if err != nil {
 		return logex.Trace(err)
 	}
-	builder := build.NewBuilder(manifest, "", nil)
 	if err := builder.Vendor(); err != nil {
 		return logex.Trace(err)
 	}
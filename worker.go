@@ -1,43 +1,98 @@
 package main
 
 import (
-	"context"
-	"encoding/base64"
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
 	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/automata-network/tee-compile/api"
 	"github.com/automata-network/tee-compile/build"
 	"github.com/automata-network/tee-compile/misc"
 	"github.com/chzyer/logex"
 )
 
 type BuildToolWorker struct {
-	Listen string `desc:"vsock://:12345"`
-	Dir    string `default:"."`
+	Listen  string `desc:"vsock://:12345"`
+	Dir     string `default:"."`
+	Jobs    int    `default:"1" desc:"max number of parallel builds"`
+	Cpus    int    `default:"0" desc:"cpus available to builds, default to all"`
+	Mem     int    `default:"0" desc:"memory(MiB) available to builds, default to all"`
+	JobCpus int    `default:"1" desc:"cpus reserved by a build by default"`
+	JobMem  int    `default:"1024" desc:"memory(MiB) reserved by a build by default"`
+	Debug   bool   `desc:"copy the logs to the console"`
 
-	Server *http.Server    `flagly:"-"`
-	logger *logex.Logger   `flagly:"-"`
-	Output *misc.LogOutput `flagly:"-"`
+	Insecure       bool          `desc:"serve an unattested certificate, for the workers outside an enclave"`
+	SessionTimeout time.Duration `default:"10m" desc:"drop the session of a host idle for that long"`
+	BlobLimit      int           `default:"4096" desc:"size(MiB) of the source blob store, 0 for unlimited"`
+	BaseEnv        string        `default:"/etc/tee-compile/env" desc:"base environment of the builds, KEY=VALUE per line"`
+	HashWorkers    int           `default:"0" desc:"files hashed in parallel, default to the cpu count"`
+
+	Server    *http.Server     `flagly:"-"`
+	Scheduler *Scheduler       `flagly:"-"`
+	Sessions  *SessionManager  `flagly:"-"`
+	Blobs     *BlobStore       `flagly:"-"`
+	baseEnv   []string         `flagly:"-"`
+	Enclave   *build.Resources `flagly:"-"`
+	logger    *logex.Logger    `flagly:"-"`
+	Output    *misc.LogOutput  `flagly:"-"`
+	logs      *misc.LogRouter  `flagly:"-"`
+	// attest signs the build report, misc.Attestation unless it's set
+	attest func(report *misc.AttestationReport) ([]byte, error) `flagly:"-"`
 }
 
-func (b *BuildToolWorker) InitLogger(w io.Writer) {
-	if w == nil {
-		b.Output = &misc.LogOutput{Stdout: os.Stdout, Stderr: os.Stderr}
+// InitLogger sends the logs of the worker itself to the console, the logs
+// of a session go to its host.
+func (b *BuildToolWorker) InitLogger() {
+	if b.logs == nil {
+		b.logs = misc.NewLogRouter(b.Debug)
+		b.Output = b.logs.Output("worker")
+		b.logger = b.logs.Logger("worker")
 	}
-	b.logger = logex.NewLoggerEx(b.Output.Stdout)
 }
 
 func (b *BuildToolWorker) FlaglyHandle() error {
-	b.InitLogger(nil)
+	b.InitLogger()
 
-	if err := os.Chdir(b.Dir); err != nil {
+	if err := os.MkdirAll(b.Dir, 0755); err != nil {
+		return logex.Trace(err)
+	}
+	memTotal, err := misc.MemTotal()
+	if err != nil {
+		return logex.Trace(err)
+	}
+	b.Enclave = &build.Resources{Cpus: runtime.NumCPU(), Memory: memTotal}
+	if b.Cpus <= 0 {
+		b.Cpus = b.Enclave.Cpus
+	}
+	if b.Mem <= 0 {
+		b.Mem = b.Enclave.Memory
+	}
+	b.baseEnv, err = build.LoadBaseEnv(b.BaseEnv)
+	if err != nil {
 		return logex.Trace(err)
 	}
+	b.Scheduler = NewScheduler(b.Jobs, b.Cpus, b.Mem)
+	b.Sessions = NewSessionManager(b.SessionTimeout, b.closeSession)
+	if err := os.RemoveAll(b.uploadsDir()); err != nil {
+		return logex.Trace(err)
+	}
+	b.Blobs, err = NewBlobStore(filepath.Join(b.Dir, "blobs"), int64(b.BlobLimit)<<20)
+	if err != nil {
+		return logex.Trace(err)
+	}
+	b.logger.Infof("scheduler: jobs=%v, cpus=%v, mem=%vMiB", b.Jobs, b.Cpus, b.Mem)
+
 	uri, err := url.Parse(b.Listen)
 	if err != nil {
 		return logex.Trace(err)
@@ -48,6 +103,25 @@ func (b *BuildToolWorker) FlaglyHandle() error {
 	}
 	defer listener.Close()
 
+	// the key never leaves the enclave, the host only talks to the
+	// attested public key
+	attest := misc.AttestPublicKey
+	if b.Insecure {
+		b.logger.Warn("serving an unattested certificate")
+		attest = nil
+	}
+	certifier, err := misc.NewRATLSCertifier(attest)
+	if err != nil {
+		return logex.Trace(err)
+	}
+	if _, err := certifier.Certificate(); err != nil {
+		return logex.Trace(err, "attest the tls key, -insecure outside an enclave")
+	}
+	listener = tls.NewListener(listener, &tls.Config{
+		GetCertificate: certifier.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+	})
+
 	b.Server = &http.Server{
 		Addr:    uri.Host,
 		Handler: b,
@@ -60,32 +134,137 @@ func (b *BuildToolWorker) FlaglyHandle() error {
 	return nil
 }
 
+func (b *BuildToolWorker) uploadsDir() string {
+	return filepath.Join(b.Dir, "uploads")
+}
+
+// closeSession drops the uploads and the pending sources of the session
+// and closes its log stream.
+func (b *BuildToolWorker) closeSession(session *Session) {
+	session.Logger.Info("session closed")
+	session.Uploads.Clear()
+	if err := os.RemoveAll(session.Uploads.Dir); err != nil {
+		b.logger.Error(err)
+	}
+	b.Blobs.RemoveSources(session.Sources())
+	if stream := session.Logs.SetStream(nil); stream != nil {
+		stream.Close()
+	}
+}
+
+// BuildRequest takes the source from either the uploaded Tarball or the
+// Source manifest rebuilt from the blob store. Manifest is the path of the
+// build manifest in the source, HashAlgorithms overrides its algorithms.
+// The Vendors tarballs are extracted into the home of the build. The logs
+// of the build go to Logs, the session of the host, or the worker logs.
+type BuildRequest struct {
+	Nonce          string
+	Resources      *build.Resources
+	Tarball        string
+	Source         string
+	Vendors        []string
+	Manifest       string
+	HashAlgorithms []string
+	Logs           *misc.LogRouter
+}
+
 type BuildResult struct {
-	Report []byte
-	Body   io.ReadCloser
+	JobID      string
+	Report     []byte
+	Provenance []byte
+	Transcript string
+	Outputs    []*OutputResult
+	Workspace  *Workspace
+
+	transcript *os.File
 }
 
-func (b *BuildToolWorker) Vendor(target string, data io.Reader) error {
-	if err := os.MkdirAll(target, 0755); err != nil {
-		return logex.Trace(err)
+// OutputResult is an output set of the build, matrix builds have one per
+// variant and name their parts after it. Proofs has the proofs of each hash
+// algorithm.
+type OutputResult struct {
+	Name   string
+	Proofs []*misc.MerkleProofs
+	Output io.ReadCloser
+}
+
+func (r *OutputResult) partName(name string) string {
+	if r.Name == "" {
+		return name
 	}
-	fd, err := os.CreateTemp("", "worker-vendor-tar-*")
+	return name + "." + r.Name
+}
+
+func (r *BuildResult) Parts() ([]*api.Part, error) {
+	transcript, err := os.Open(r.Transcript)
 	if err != nil {
-		return logex.Trace(err)
+		return nil, logex.Trace(err)
 	}
-	defer fd.Close()
-	defer os.Remove(fd.Name())
+	r.transcript = transcript
+	var parts []*api.Part
+	for _, output := range r.Outputs {
+		parts = append(parts, &api.Part{Name: output.partName(api.PartOutput), ContentType: "application/x-tar", Body: output.Output})
+		for idx, proofs := range output.Proofs {
+			data, err := json.MarshalIndent(proofs, "", "\t")
+			if err != nil {
+				return nil, logex.Trace(err)
+			}
+			parts = append(parts, &api.Part{
+				Name:        output.partName(api.ProofsPart(string(proofs.Algorithm), idx == 0)),
+				ContentType: "application/json",
+				Body:        bytes.NewReader(data),
+			})
+		}
+	}
+	return append(parts,
+		&api.Part{Name: api.PartProvenance, ContentType: "application/json", Body: bytes.NewReader(r.Provenance)},
+		&api.Part{Name: api.PartTranscript, ContentType: "text/plain", Body: transcript},
+		&api.Part{Name: api.PartReport, ContentType: "application/cbor", Body: bytes.NewReader(r.Report)},
+	), nil
+}
 
-	if _, err := io.Copy(fd, data); err != nil {
-		return logex.Trace(err)
+func (r *BuildResult) Close() error {
+	closeOutputs(r.Outputs)
+	if r.transcript != nil {
+		r.transcript.Close()
 	}
+	return r.Workspace.Close()
+}
 
-	if err := misc.InDir(target, func() error {
-		if err := misc.Exec(b.Output, "tar", "xvf", fd.Name()); err != nil {
-			return logex.Trace(err)
+// Workspace is the per-build directory tree, it's wiped after the build.
+// Home is the HOME of the build, nothing of a build outlives it.
+type Workspace struct {
+	Root   string
+	Source string
+	Home   string
+}
+
+func NewWorkspace(dir string) (*Workspace, error) {
+	root, err := os.MkdirTemp(dir, "build-*")
+	if err != nil {
+		return nil, logex.Trace(err)
+	}
+	root, err = filepath.Abs(root)
+	if err != nil {
+		os.RemoveAll(root)
+		return nil, logex.Trace(err)
+	}
+	ws := &Workspace{
+		Root:   root,
+		Source: filepath.Join(root, "src"),
+		Home:   filepath.Join(root, "home"),
+	}
+	for _, dir := range []string{ws.Source, ws.Home} {
+		if err := os.Mkdir(dir, 0755); err != nil {
+			ws.Close()
+			return nil, logex.Trace(err)
 		}
-		return nil
-	}); err != nil {
+	}
+	return ws, nil
+}
+
+func (w *Workspace) Close() error {
+	if err := os.RemoveAll(w.Root); err != nil {
 		return logex.Trace(err)
 	}
 	return nil
@@ -117,101 +296,444 @@ func (b *BuildToolWorker) TestSpace() error {
 	return nil
 }
 
-func (b *BuildToolWorker) Build(data io.Reader, nonce string) (*BuildResult, error) {
-	fd, err := os.CreateTemp("", "worker-builder-tar-*")
+func (b *BuildToolWorker) Build(req *BuildRequest) (result *BuildResult, err error) {
+	job := b.Scheduler.NewJob(req.Nonce)
+	defer func() {
+		// the job is finished even if the build panics
+		if r := recover(); r != nil {
+			b.Scheduler.Done(job, logex.NewErrorf("panic: %v", r))
+			panic(r)
+		}
+		b.Scheduler.Done(job, err)
+	}()
+	transcript, err := misc.NewTranscript(filepath.Join(b.Dir, fmt.Sprintf("job-%v.log", job.ID)))
 	if err != nil {
 		return nil, logex.Trace(err)
 	}
-	defer fd.Close()
-	defer os.Remove(fd.Name())
-
-	if _, err := io.Copy(fd, data); err != nil {
+	b.Scheduler.SetTranscript(job, transcript)
+	defer transcript.Seal()
+	logs := req.Logs
+	if logs == nil {
+		logs = b.logs
+	}
+	out := transcript.Tee(logs.Output("build").WithPrefix(fmt.Sprintf("[job-%v] ", job.ID)))
+	ws, err := NewWorkspace(b.Dir)
+	if err != nil {
+		return nil, logex.Trace(err)
+	}
+	defer func() {
+		if result == nil {
+			ws.Close()
+		}
+	}()
+	result, err = b.build(job, out, ws, req)
+	if err != nil {
 		return nil, logex.Trace(err)
 	}
+	return result, nil
+}
 
-	if err := misc.Exec(b.Output, "tar", "xvf", fd.Name()); err != nil {
+func (b *BuildToolWorker) build(job *Job, out *misc.LogOutput, ws *Workspace, req *BuildRequest) (*BuildResult, error) {
+	logger := out.Logger()
+	if req.Source != "" {
+		logger.Infof("materialize source %v", req.Source)
+		if err := b.Blobs.Materialize(req.Source, ws.Source); err != nil {
+			return nil, logex.Trace(err)
+		}
+	} else if err := misc.Untar(out, req.Tarball, ws.Source); err != nil {
 		return nil, logex.Trace(err)
 	}
+	for _, vendor := range req.Vendors {
+		if err := misc.Untar(out, vendor, ws.Home); err != nil {
+			return nil, logex.Trace(err)
+		}
+	}
 
-	os.Remove(fd.Name())
+	manifest, err := build.LoadManifest(ws.Source, req.Manifest)
+	if err != nil {
+		return nil, api.WithStatus(err, http.StatusUnprocessableEntity)
+	}
+	hashAlgorithms, err := misc.ParseHashAlgorithms(manifest.HashAlgorithms)
+	if err != nil {
+		return nil, api.WithStatus(err, http.StatusUnprocessableEntity)
+	}
+	if len(req.HashAlgorithms) > 0 {
+		hashAlgorithms, err = misc.ParseHashAlgorithms(req.HashAlgorithms)
+		if err != nil {
+			return nil, api.WithStatus(err, http.StatusBadRequest)
+		}
+	}
 
-	manifest, err := build.NewManifest("build.json")
+	resources := (&build.Resources{Cpus: b.JobCpus, Memory: b.JobMem}).
+		Override(manifest.Resources).
+		Override(req.Resources)
+	// the resources of a nitro build also size its enclave, whose usable
+	// memory is always less than what it was booted with, so a build gets
+	// at most what the worker has
+	if resources.Cpus > b.Cpus {
+		resources.Cpus = b.Cpus
+	}
+	if resources.Memory > b.Mem {
+		resources.Memory = b.Mem
+	}
+	free, err := misc.DiskFree(ws.Root)
 	if err != nil {
 		return nil, logex.Trace(err)
 	}
+	if resources.Workspace > free {
+		return nil, api.WithStatus(logex.NewErrorf(
+			"build requires %vMiB workspace, only %vMiB available", resources.Workspace, free,
+		), http.StatusBadRequest)
+	}
+	enclave := *b.Enclave
+	enclave.Workspace = free
+
+	builder := build.NewBuilder(ws.Source, manifest, req.Nonce, out)
+	builder.BaseEnv = build.MergeEnv(b.baseEnv, []string{"HOME=" + ws.Home})
+	builder.HashAlgorithms = hashAlgorithms
+	builder.HashWorkers = b.HashWorkers
+	builder.Provenance.Resources = resources
+	builder.Provenance.Enclave = &enclave
+	var outputs []*OutputResult
+	var reportData, provenance []byte
+	if err := b.Scheduler.Run(job, resources.Cpus, resources.Memory, func() error {
+		if err := builder.Build(); err != nil {
+			return api.WithStatus(err, http.StatusUnprocessableEntity)
+		}
 
-	builder := build.NewBuilder(manifest, nonce, b.Output)
-	if err := builder.Build(); err != nil {
+		tarFiles, err := builder.Tar(ws.Root)
+		if err != nil {
+			return logex.Trace(err)
+		}
+		for idx, output := range builder.Outputs {
+			proofs := make([]*misc.MerkleProofs, len(output.Results))
+			for i, result := range output.Results {
+				proofs[i], err = result.Proofs()
+				if err != nil {
+					closeOutputs(outputs)
+					return logex.Trace(err)
+				}
+			}
+			outputFd, err := os.Open(tarFiles[idx])
+			if err != nil {
+				closeOutputs(outputs)
+				return logex.Trace(err)
+			}
+			outputs = append(outputs, &OutputResult{Name: output.Name, Proofs: proofs, Output: outputFd})
+		}
+
+		provenance, err = builder.Provenance.Encode()
+		if err != nil {
+			closeOutputs(outputs)
+			return logex.Trace(err)
+		}
+
+		inputRoots := make([][]byte, len(builder.InputResults))
+		for idx, result := range builder.InputResults {
+			inputRoots[idx] = result.Root
+		}
+
+		logHash, err := job.Transcript.Seal()
+		if err != nil {
+			closeOutputs(outputs)
+			return logex.Trace(err)
+		}
+
+		attest := b.attest
+		if attest == nil {
+			attest = misc.Attestation
+		}
+		reportData, err = attest(&misc.AttestationReport{
+			Nonce:          req.Nonce,
+			InputHash:      fmt.Sprintf("0x%x", builder.InputResult.Root),
+			OutputHash:     fmt.Sprintf("0x%x", builder.OutputRoot),
+			Mrenclave:      builder.OutputMrenclave,
+			ProvenanceHash: build.ProvenanceHash(provenance),
+			LogHash:        logHash,
+			Manifest:       manifest.Path,
+			ManifestHash:   manifest.Hash,
+			LeafVersion:    misc.LeafVersion,
+			HashAlgorithm:  hashAlgorithms[0],
+			InputHashes:    misc.RootHashes(hashAlgorithms, inputRoots),
+			OutputHashes:   misc.RootHashes(hashAlgorithms, builder.OutputRoots),
+		})
+		if err != nil {
+			closeOutputs(outputs)
+			return logex.Trace(err)
+		}
+		return nil
+	}); err != nil {
 		return nil, logex.Trace(err)
 	}
 
-	output, err := builder.Tar()
+	logger.Infof("hash: %x", builder.OutputRoot)
+
+	return &BuildResult{
+		JobID:      job.ID,
+		Report:     reportData,
+		Provenance: provenance,
+		Transcript: job.Transcript.Path,
+		Outputs:    outputs,
+		Workspace:  ws,
+	}, nil
+}
+
+func closeOutputs(outputs []*OutputResult) {
+	for _, output := range outputs {
+		output.Output.Close()
+	}
+}
+
+var workerMethods = map[string]string{
+	api.PathHandshake: http.MethodPost,
+	api.PathSession:   http.MethodDelete,
+	api.PathBuild:     http.MethodPost,
+	api.PathBuilds:    http.MethodGet,
+	api.PathBuildLog:  http.MethodGet,
+	api.PathTestSpace: http.MethodPost,
+
+	api.PathUploads:      http.MethodPost,
+	api.PathUploadChunk:  http.MethodPut,
+	api.PathUploadStatus: http.MethodGet,
+	api.PathUploadCommit: http.MethodPost,
+
+	api.PathSources: http.MethodPost,
+	api.PathBlobs:   http.MethodPost,
+}
+
+func (b *BuildToolWorker) Handshake(req *api.HandshakeRequest) (*api.HandshakeResponse, error) {
+	if req.Version != api.Version {
+		return nil, api.WithStatus(logex.NewErrorf(
+			"host(%v) speaks protocol v%v, worker(%v) speaks v%v, the host binary and the enclave image must come from the same release",
+			req.Software, req.Version, Version, api.Version,
+		), http.StatusUpgradeRequired)
+	}
+	if req.Software != Version {
+		b.logger.Warnf("host version %v differs from worker version %v", req.Software, Version)
+	}
+	uri, err := misc.ParseURI(req.Log)
 	if err != nil {
+		return nil, api.WithStatus(err, http.StatusBadRequest)
+	}
+	if req.LogCert == "" {
+		return nil, api.WithStatus(logex.NewErrorf("missing the certificate of the log listener"), http.StatusBadRequest)
+	}
+	if err := os.MkdirAll(b.uploadsDir(), 0755); err != nil {
 		return nil, logex.Trace(err)
 	}
-	outputFd, err := os.Open(output)
+	uploadsDir, err := os.MkdirTemp(b.uploadsDir(), "session-*")
 	if err != nil {
 		return nil, logex.Trace(err)
 	}
-
-	reportData, err := misc.Attestation(&misc.AttestationReport{
-		Nonce:      nonce,
-		InputHash:  fmt.Sprintf("0x%x", builder.InputResult.Root),
-		OutputHash: fmt.Sprintf("0x%x", builder.OutputResult.Root),
-		Mrenclave:  builder.OutputMrenclave,
+	uploads, err := NewUploadStore(uploadsDir)
+	if err != nil {
+		return nil, logex.Trace(err)
+	}
+	// the build logs may reveal the source, they only go to the host
+	logs := misc.NewLogRouter(b.Debug)
+	logs.SetStream(misc.NewLogStream(uri, api.PathLog, 1024, misc.PinnedTLSConfig(req.LogCert)))
+	session, err := b.Sessions.Open(&Session{
+		Host:    uri.String(),
+		Uploads: uploads,
+		Logs:    logs,
+		Logger:  logs.Logger("worker"),
 	})
 	if err != nil {
+		os.RemoveAll(uploadsDir)
+		logs.SetStream(nil).Close()
 		return nil, logex.Trace(err)
 	}
-
-	b.logger.Infof("hash: %x", builder.OutputResult.Root)
-
-	return &BuildResult{
-		Report: reportData,
-		Body:   outputFd,
+	session.Logger.Info("session opened, set logger:", uri)
+	return &api.HandshakeResponse{
+		Version:  api.Version,
+		Software: Version,
+		Session:  session.Token,
 	}, nil
 }
 
 func (b *BuildToolWorker) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	defer req.Body.Close()
 
+	method, ok := workerMethods[req.URL.Path]
+	if !ok {
+		api.WriteError(w, api.WithStatus(logex.NewErrorf("unknown path: %v", req.URL.Path), http.StatusNotFound))
+		return
+	}
+	if req.Method != method {
+		api.WriteError(w, api.WithStatus(logex.NewErrorf("%v requires %v", req.URL.Path, method), http.StatusMethodNotAllowed))
+		return
+	}
+	var session *Session
+	if req.URL.Path != api.PathHandshake {
+		var release func()
+		var err error
+		session, release, err = b.Sessions.Authorize(req)
+		if err != nil {
+			api.WriteError(w, err)
+			return
+		}
+		defer release()
+	}
 	query := req.URL.Query()
 
 	switch req.URL.Path {
-	case "/ping":
-		url := fmt.Sprintf("http://%v/log", query.Get("host"))
-		logex.Info("set logger:", url)
-		b.InitLogger(misc.NewVsockLogWriter(url))
-	case "/build":
-		report, err := b.Build(req.Body, query.Get("nonce"))
-		if err != nil {
-			w.WriteHeader(400)
-			fmt.Fprint(w, err.Error())
-		} else {
-			w.Header().Set("Report", base64.URLEncoding.EncodeToString(report.Report))
-			w.WriteHeader(200)
-			io.Copy(w, report.Body)
-			report.Body.Close()
-		}
-
-		b.logger.Info("build finished")
-
-		go func() {
-			// TODO: remove file
-			time.Sleep(time.Second)
-			b.Server.Shutdown(context.TODO())
-			b.logger.Info("shutdown")
-		}()
-	case "/testspace":
-		b.TestSpace()
-	case "/vendor":
-		target := req.URL.Query().Get("target")
-		if err := b.Vendor(target, req.Body); err != nil {
-			w.WriteHeader(400)
-			fmt.Fprint(w, err.Error())
+	case api.PathHandshake:
+		var handshake api.HandshakeRequest
+		if err := json.NewDecoder(req.Body).Decode(&handshake); err != nil {
+			api.WriteError(w, api.WithStatus(err, http.StatusBadRequest))
+			return
+		}
+		response, err := b.Handshake(&handshake)
+		if err != nil {
+			api.WriteError(w, err)
+			return
+		}
+		api.WriteJSON(w, response)
+	case api.PathSession:
+		if err := b.Sessions.Close(req); err != nil {
+			api.WriteError(w, err)
+			return
+		}
+	case api.PathBuild:
+		buildReq := &BuildRequest{
+			Nonce:     query.Get("nonce"),
+			Resources: &build.Resources{},
+			Manifest:  query.Get("manifest"),
+			Logs:      session.Logs,
+		}
+		if hash := query.Get("hash"); hash != "" {
+			buildReq.HashAlgorithms = strings.Split(hash, ",")
+		}
+		for key, field := range map[string]*int{
+			"cpus":      &buildReq.Resources.Cpus,
+			"mem":       &buildReq.Resources.Memory,
+			"workspace": &buildReq.Resources.Workspace,
+		} {
+			if query.Get(key) == "" {
+				continue
+			}
+			n, err := strconv.Atoi(query.Get(key))
+			if err != nil {
+				api.WriteError(w, api.WithStatus(logex.Trace(err, key), http.StatusBadRequest))
+				return
+			}
+			*field = n
+		}
+		for _, id := range query["vendor"] {
+			tarFile, err := session.Uploads.Take(id)
+			if err != nil {
+				api.WriteError(w, err)
+				return
+			}
+			defer os.Remove(tarFile)
+			buildReq.Vendors = append(buildReq.Vendors, tarFile)
+		}
+		if buildReq.Source = query.Get("source"); buildReq.Source != "" {
+			if err := session.Source(buildReq.Source); err != nil {
+				api.WriteError(w, err)
+				return
+			}
 		} else {
-			w.WriteHeader(200)
+			tarFile, err := session.Uploads.Take(query.Get("upload"))
+			if err != nil {
+				api.WriteError(w, err)
+				return
+			}
+			defer os.Remove(tarFile)
+			buildReq.Tarball = tarFile
+		}
+		report, err := b.Build(buildReq)
+		if err != nil {
+			session.Logger.Error("build failed:", err)
+			api.WriteError(w, err)
+			return
 		}
+		defer report.Close()
+		parts, err := report.Parts()
+		if err != nil {
+			api.WriteError(w, err)
+			return
+		}
+		if err := api.WriteParts(w, parts); err != nil {
+			session.Logger.Error("send build result failed:", err)
+			return
+		}
+		session.Logger.Infof("build job-%v finished", report.JobID)
+	case api.PathBuilds:
+		api.WriteJSON(w, b.Scheduler.List())
+	case api.PathBuildLog:
+		transcript, err := b.Scheduler.Transcript(query.Get("id"))
+		if err != nil {
+			api.WriteError(w, err)
+			return
+		}
+		http.ServeFile(w, req, transcript.Path)
+	case api.PathTestSpace:
+		if err := b.TestSpace(); err != nil {
+			api.WriteError(w, err)
+		}
+	case api.PathSources:
+		var manifest api.SourceManifest
+		if err := json.NewDecoder(req.Body).Decode(&manifest); err != nil {
+			api.WriteError(w, api.WithStatus(err, http.StatusBadRequest))
+			return
+		}
+		status, err := b.Blobs.AddSource(&manifest)
+		if err != nil {
+			api.WriteError(w, err)
+			return
+		}
+		session.AddSource(status.ID)
+		session.Logger.Infof("source %v: %v entries, %v blobs missing", status.ID, len(manifest.Entries), len(status.Missing))
+		api.WriteJSON(w, status)
+	case api.PathBlobs:
+		if err := session.Source(query.Get("source")); err != nil {
+			api.WriteError(w, err)
+			return
+		}
+		tarFile, err := session.Uploads.Take(query.Get("upload"))
+		if err != nil {
+			api.WriteError(w, err)
+			return
+		}
+		defer os.Remove(tarFile)
+		if _, err := b.Blobs.Ingest(tarFile); err != nil {
+			api.WriteError(w, err)
+			return
+		}
+		status, err := b.Blobs.Status(query.Get("source"))
+		if err != nil {
+			api.WriteError(w, err)
+			return
+		}
+		api.WriteJSON(w, status)
+	case api.PathUploads:
+		var upload api.UploadRequest
+		if err := json.NewDecoder(req.Body).Decode(&upload); err != nil {
+			api.WriteError(w, api.WithStatus(err, http.StatusBadRequest))
+			return
+		}
+		writeUploadStatus(w)(session.Uploads.Create(&upload))
+	case api.PathUploadChunk:
+		offset, err := strconv.ParseInt(query.Get("offset"), 10, 64)
+		if err != nil {
+			api.WriteError(w, api.WithStatus(logex.Trace(err, "offset"), http.StatusBadRequest))
+			return
+		}
+		writeUploadStatus(w)(session.Uploads.Append(query.Get("id"), offset, req.Header.Get(api.HeaderChunkSha256), req.Body))
+	case api.PathUploadStatus:
+		writeUploadStatus(w)(session.Uploads.Status(query.Get("id")))
+	case api.PathUploadCommit:
+		writeUploadStatus(w)(session.Uploads.Commit(query.Get("id")))
 	}
+}
 
+func writeUploadStatus(w http.ResponseWriter) func(*api.UploadStatus, error) {
+	return func(status *api.UploadStatus, err error) {
+		if err != nil {
+			api.WriteError(w, err)
+			return
+		}
+		api.WriteJSON(w, status)
+	}
 }
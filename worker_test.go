@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/automata-network/tee-compile/build"
+	"github.com/automata-network/tee-compile/misc"
+)
+
+func newTestWorker(t *testing.T, cpus, mem int) *BuildToolWorker {
+	t.Helper()
+	dir := t.TempDir()
+	b := &BuildToolWorker{
+		Dir:     dir,
+		Jobs:    1,
+		Cpus:    cpus,
+		Mem:     mem,
+		JobCpus: 1,
+		JobMem:  1024,
+		Enclave: &build.Resources{Cpus: cpus, Memory: mem},
+		baseEnv: build.DefaultBaseEnv,
+		attest: func(report *misc.AttestationReport) ([]byte, error) {
+			return json.Marshal(report)
+		},
+	}
+	b.InitLogger()
+	b.Scheduler = NewScheduler(b.Jobs, b.Cpus, b.Mem)
+	return b
+}
+
+func newTestSource(t *testing.T, manifest string) string {
+	t.Helper()
+	src := t.TempDir()
+	files := map[string]string{
+		"build.json": manifest,
+		".git/HEAD":  "ref: refs/heads/master\n",
+	}
+	for name, content := range files {
+		fp := filepath.Join(src, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(fp), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(fp, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tarball, err := misc.TarTo(nil, src, t.TempDir(), "source", []string{"."})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tarball
+}
+
+// The resources of a nitro build size its enclave, the worker inside only
+// has part of that memory and must still run the build.
+func TestWorkerBuildEnclaveResources(t *testing.T) {
+	const cpus, mem = 2, 3800
+	cases := []struct {
+		name      string
+		resources string
+		request   *build.Resources
+		cpus, mem int
+	}{
+		{"default", ``, nil, 1, 1024},
+		{"manifest", `"resources": {"cpus": 2, "memory": 4096},`, nil, 2, mem},
+		{"request", ``, &build.Resources{Cpus: 4, Memory: misc.NitroDefaultMemory}, cpus, mem},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			b := newTestWorker(t, cpus, mem)
+			tarball := newTestSource(t, `{`+c.resources+`
+				"input": {"cmd": "echo hello > out.txt"},
+				"output": {"files": ["out.txt"]}
+			}`)
+			result, err := b.Build(&BuildRequest{Nonce: "nonce", Tarball: tarball, Resources: c.request})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer result.Close()
+
+			jobs := b.Scheduler.List()
+			if len(jobs) != 1 {
+				t.Fatalf("got %v jobs", len(jobs))
+			}
+			job := jobs[0]
+			if job.State != JobFinished || job.Cpus != c.cpus || job.Mem != c.mem {
+				t.Fatalf("job %v: cpus=%v, mem=%v, expect %v, %v", job.State, job.Cpus, job.Mem, c.cpus, c.mem)
+			}
+			var report misc.AttestationReport
+			if err := json.Unmarshal(result.Report, &report); err != nil {
+				t.Fatal(err)
+			}
+			if report.Nonce != "nonce" || report.OutputHash == "" {
+				t.Fatalf("unexpected report: %+v", report)
+			}
+		})
+	}
+}